@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// payloadChunk is how many bytes of a file go into one printf
+// command, keeping the lines of the payload at a sane length.
+const payloadChunk = 4096
+
+// writePayload writes shell commands to w that recreate the named file
+// or directory in the current directory, using nothing but printf, a
+// builtin in every shell worth its salt, and the tools the remote
+// machines already need, plus chmod(1) to restore the modes: without
+// it, the script couldn't be executed.
+// Symbolic links are followed, as scp(1) would.
+func writePayload(w io.Writer, fname string) error {
+	root := filepath.Dir(fname)
+	modes := make(map[os.FileMode][]string)
+	var order []os.FileMode
+	err := filepath.Walk(fname, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(p); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return fmt.Errorf("%s: can't follow link to directory", p)
+			}
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name = shquote(filepath.ToSlash(name))
+		switch {
+		case info.IsDir():
+			fmt.Fprintf(w, "mkdir %s || exit\n", name)
+		case info.Mode().IsRegular():
+			if err = writePrintf(w, p, name); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: not a regular file", p)
+		}
+		mode := info.Mode().Perm()
+		if modes[mode] == nil {
+			order = append(order, mode)
+		}
+		// directories go last, so that they don't lock out the rest
+		modes[mode] = append([]string{name}, modes[mode]...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var b []string
+	for _, mode := range order {
+		b = append(b, fmt.Sprintf("chmod %04o %s || exit\n",
+			mode, strings.Join(modes[mode], " ")))
+	}
+	_, err = io.WriteString(w, strings.Join(b, ""))
+	return err
+}
+
+// writePrintf writes the printf commands that recreate the named file
+// under the given (quoted) name. All bytes but the harmless ones are
+// written as octal escapes.
+func writePrintf(w io.Writer, fname string, name string) error {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, ": > %s || exit\n", name)
+	for len(data) > 0 {
+		n := len(data)
+		if n > payloadChunk {
+			n = payloadChunk
+		}
+		var b strings.Builder
+		for _, c := range data[:n] {
+			switch {
+			case c == '%':
+				b.WriteString("%%")
+			case c == '\\' || c == '\'' || c < ' ' || c > '~':
+				fmt.Fprintf(&b, "\\%03o", c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		fmt.Fprintf(w, "printf '%s' >> %s || exit\n", b.String(), name)
+		data = data[n:]
+	}
+	return nil
+}
+
+// Payload returns the shell commands that recreate the script in the
+// current directory. Like the Bundle, it is built once, on first use.
+func (script *Script) Payload() ([]byte, error) {
+	staged, err := script.Staged()
+	if err != nil {
+		return nil, err
+	}
+	script.m.Lock()
+	defer script.m.Unlock()
+	if script.payload == nil {
+		var b bytes.Buffer
+		if err := writePayload(&b, staged); err != nil {
+			return nil, err
+		}
+		script.payload = b.Bytes()
+	}
+	return script.payload, nil
+}
+
+// bootstrapScript returns the shell script that, in one go, creates
+// the workdir (the way makeWorkdir would, reporting problems on
+// standard error), recreates the script there from the payload that
+// follows, runs it, and removes the workdir, even if interrupted. The
+// script is read by "sh -s"; the payload ends with bootstrapRun.
+func (host *Host) bootstrapScript(job *Job) string {
+	dst := path.Dir(path.Clean(job.Script.fname))
+	return strings.Join([]string{
+		"{",
+		host.selectWorkdir(job, "exit 1"),
+		"} >&2",
+		`trap 'rm -r "$w"' EXIT`,
+		`trap 'exit 1' HUP INT TERM`,
+		markerCommand(job, `"$w"`) + " || exit",
+		fmt.Sprintf(`mkdir -p "$w"/%s || exit`, shquote(dst)),
+		fmt.Sprintf(`cd "$w"/%s || exit`, shquote(dst)),
+		"",
+	}, "\n")
+}
+
+// bootstrapRun returns the end of the bootstrap script: the command
+// that runs the script in the workdir, with no input.
+func (host *Host) bootstrapRun(job *Job) string {
+	fname := path.Clean(job.Script.fname)
+	remoteCommand := fname
+	if job.Script.dirmode {
+		remoteCommand = path.Join(fname, "script")
+	}
+	args := []string{`cd "$w" &&`, "env"}
+	for key, value := range host.Environment() {
+		args = append(args, fmt.Sprintf("%s=%s", key, shquote(value)))
+	}
+	args = append(args, "sh", "-c", shquote(shquote(
+		path.Join(".", remoteCommand),
+	)), "< /dev/null")
+	return strings.Join(args, " ") + "\n"
+}
+
+// Bootstrap sends and runs the job's script in a single round trip:
+// the remote shell reads a script on its standard input, which sets up
+// the workdir, recreates the job's script there, runs it, and cleans
+// up after itself.
+func (host *Host) Bootstrap(job *Job) error {
+	payload, err := job.Script.Payload()
+	if err != nil {
+		return err
+	}
+	host.recording = job.recordsOutput()
+	defer func() {
+		host.recording = false
+	}()
+	proc, err := host.transport.Run(job, "sh -s", io.MultiReader(
+		strings.NewReader(host.bootstrapScript(job)),
+		bytes.NewReader(payload),
+		strings.NewReader(host.bootstrapRun(job)),
+	))
+	if err != nil {
+		return err
+	}
+	return host.follow(job, proc)
+}
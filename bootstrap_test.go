@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestHostBootstrapLocal(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript("examples/hello.sh")
+	assert(err)
+	job := newTestJob(script, nil)
+	job.Bootstrap = true
+	if err = host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Join(host.Output, "\n") != "Hello from localhost!" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestHostBootstrapLocalDirMode(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript("examples/bootstrap")
+	assert(err)
+	job := newTestJob(script, nil)
+	job.Bootstrap = true
+	if err = host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(host.Output) != 3 || host.Output[2] != "My data: 0xCAFEBABE" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestHostBootstrapLocalModes(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript(makeTestBundle(t))
+	assert(err)
+	job := newTestJob(script, nil)
+	job.Bootstrap = true
+	if err = host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	// symbolic links are followed
+	if len(host.Output) != 2 || host.Output[0] != "tool is executable" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestHostBootstrapLocalQuoting(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript("examples/hello.sh")
+	assert(err)
+	job := newTestJob(script, nil)
+	job.Bootstrap = true
+	host.Env["HOSTNAME"] = "it's; exit 3"
+	if err = host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+	}
+	if strings.Join(host.Output, "\n") != "Hello from it's; exit 3!" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestHostBootstrapLocalFailure(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	fname := path.Join(t.TempDir(), "fail.sh")
+	assert(os.WriteFile(fname, []byte("#!/bin/sh\nexit 3\n"), 0755))
+	script, err := NewScript(fname)
+	assert(err)
+	job := newTestJob(script, nil)
+	job.Bootstrap = true
+	if err = host.SendRemoteAndRun(job); err == nil {
+		t.Error("exit status lost")
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestWritePayload(t *testing.T) {
+	src := path.Join(t.TempDir(), "src")
+	assert(os.Mkdir(src, 0750))
+	var data []byte
+	for i := 0; i < 3*payloadChunk; i++ {
+		data = append(data, byte(i))
+	}
+	data = append(data, "%s %% \\ ' \n"...)
+	assert(os.WriteFile(path.Join(src, "data"), data, 0640))
+	assert(os.WriteFile(path.Join(src, "empty"), nil, 0700))
+	var b bytes.Buffer
+	assert(writePayload(&b, src))
+
+	dst := t.TempDir()
+	cmd := exec.Command("sh", "-s")
+	cmd.Dir = dst
+	cmd.Stdin = &b
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Error(err, string(out))
+		return
+	}
+	got, err := os.ReadFile(path.Join(dst, "src/data"))
+	assert(err)
+	if !bytes.Equal(got, data) {
+		t.Error("data mangled")
+	}
+	for name, mode := range map[string]os.FileMode{
+		"src": 0750 | os.ModeDir, "src/data": 0640, "src/empty": 0700,
+	} {
+		info, err := os.Stat(path.Join(dst, name))
+		assert(err)
+		if info.Mode() != mode {
+			t.Errorf("%s: mode %s", name, info.Mode())
+		}
+	}
+}
+
+func TestHostBootstrapRemoteDirFallback(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	job := newTestJob(writeTestScript(t, "pwd\n"), nil)
+	job.Bootstrap = true
+	job.RemoteDir = "/proc/judo"
+	if err := host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(host.Output) != 1 || !strings.HasPrefix(host.Output[0], tmp+"/") {
+		t.Error("output:", host.Output)
+	}
+}
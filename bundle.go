@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// Bundle is a script packed into a tar archive, optionally gzipped,
+// ready to be streamed to any number of hosts. Sum is the archive's
+// POSIX cksum(1) CRC, which the remote end checks before unpacking.
+type Bundle struct {
+	Data       []byte
+	Sum        uint32
+	Compressed bool
+}
+
+// NewBundle packs the named file or directory into a Bundle.
+func NewBundle(fname string, compress bool) (*Bundle, error) {
+	var b bytes.Buffer
+	if compress {
+		zw := gzip.NewWriter(&b)
+		if err := writeTar(zw, fname); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	} else if err := writeTar(&b, fname); err != nil {
+		return nil, err
+	}
+	return &Bundle{
+		Data:       b.Bytes(),
+		Sum:        cksum(b.Bytes()),
+		Compressed: compress,
+	}, nil
+}
+
+// Compress returns the bundle, gzipped.
+func (bundle *Bundle) Compress() (*Bundle, error) {
+	if bundle.Compressed {
+		return bundle, nil
+	}
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	if _, err := zw.Write(bundle.Data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return &Bundle{Data: b.Bytes(), Sum: cksum(b.Bytes()), Compressed: true}, nil
+}
+
+// Unpack extracts the bundle into the local directory, preserving
+// modes and symbolic links.
+func (bundle *Bundle) Unpack(dir string) error {
+	var r io.Reader = bundle.Reader()
+	if bundle.Compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	// directories get their modes last, in case they're read-only
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("bad name in bundle: %s", hdr.Name)
+		}
+		fname := filepath.Join(dir, hdr.Name)
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = os.Mkdir(fname, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeSymlink:
+			if err = os.Symlink(hdr.Linkname, fname); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+			f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if errClose := f.Close(); err == nil {
+				err = errClose
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported file type", hdr.Name)
+		}
+		// set the exact mode, regardless of umask
+		if err = os.Chmod(fname, mode.Perm()); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fname := filepath.Join(dir, dirs[i].Name)
+		if err := os.Chmod(fname, dirs[i].FileInfo().Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader returns a new reader of the bundle's data.
+func (bundle *Bundle) Reader() io.Reader {
+	return bytes.NewReader(bundle.Data)
+}
+
+// UnpackCommand returns the shell command that reads the bundle from
+// standard input, checks it, and unpacks it in the remote directory.
+func (bundle *Bundle) UnpackCommand(fnameRemote string) string {
+	dir := shquote(path.Clean(fnameRemote))
+	extract := fmt.Sprintf(`tar -xpf "$f" -C %s`, dir)
+	if bundle.Compressed {
+		extract = fmt.Sprintf(`gzip -dc < "$f" | tar -xpf - -C %s`, dir)
+	}
+	return fmt.Sprintf(
+		`f=%s/.judo-bundle.$$ && cat > "$f" && `+
+			`if test "$(cksum < "$f")" = "%d %d"; then %s; `+
+			`else echo "bundle checksum mismatch" >&2; false; fi; `+
+			`s=$?; rm -f "$f"; exit $s`,
+		dir, bundle.Sum, len(bundle.Data), extract,
+	)
+}
+
+// Bundle returns the script packed into a Bundle, gzipped if asked
+// to. The files are read once, on first use, so that all hosts get
+// the same content, even if the files change while the job runs.
+func (script *Script) Bundle(compress bool) (*Bundle, error) {
+	script.m.Lock()
+	defer script.m.Unlock()
+	return script.bundleLocked(compress)
+}
+
+func (script *Script) bundleLocked(compress bool) (bundle *Bundle, err error) {
+	if script.bundle == nil {
+		if script.bundle, err = NewBundle(script.fname, false); err != nil {
+			return nil, err
+		}
+	}
+	if !compress {
+		return script.bundle, nil
+	}
+	if script.gzBundle == nil {
+		if script.gzBundle, err = script.bundle.Compress(); err != nil {
+			return nil, err
+		}
+	}
+	return script.gzBundle, nil
+}
+
+// Staged returns the path of a private copy of the script, unpacked
+// from its Bundle. All push modes send the script from here, so that
+// whichever way it travels, every host gets the very same content.
+// It is made once, on first use; Cleanup removes it.
+func (script *Script) Staged() (string, error) {
+	script.m.Lock()
+	defer script.m.Unlock()
+	if script.staged != "" {
+		return script.staged, nil
+	}
+	bundle, err := script.bundleLocked(false)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "judo.")
+	if err != nil {
+		return "", err
+	}
+	if err = bundle.Unpack(dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	script.stageDir = dir
+	script.staged = filepath.Join(dir, filepath.Base(script.fname))
+	return script.staged, nil
+}
+
+// Cleanup removes the private copy of the script, if any.
+func (script *Script) Cleanup() {
+	script.m.Lock()
+	defer script.m.Unlock()
+	if script.stageDir != "" {
+		os.RemoveAll(script.stageDir)
+		script.stageDir, script.staged = "", ""
+	}
+}
+
+// cksum computes the CRC of data the way POSIX cksum(1) does.
+func cksum(data []byte) uint32 {
+	var crc uint32
+	update := func(b byte) {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	for _, b := range data {
+		update(b)
+	}
+	for n := len(data); n > 0; n >>= 8 {
+		update(byte(n))
+	}
+	return ^crc
+}
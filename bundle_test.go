@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCksum(t *testing.T) {
+	for _, data := range []string{"", "hello\n", strings.Repeat("judo", 1000)} {
+		cmd := exec.Command("cksum")
+		cmd.Stdin = strings.NewReader(data)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Skip("no cksum(1):", err)
+		}
+		expect := fmt.Sprintf("%d %d", cksum([]byte(data)), len(data))
+		if strings.TrimSpace(string(out)) != expect {
+			t.Errorf("cksum: %q != %q", out, expect)
+		}
+	}
+}
+
+func TestScriptBundleOnce(t *testing.T) {
+	script, err := NewScript(makeTestBundle(t))
+	assert(err)
+	bundle1, err := script.Bundle(false)
+	assert(err)
+	bundle2, err := script.Bundle(false)
+	assert(err)
+	if bundle1 != bundle2 {
+		t.Error("bundle built twice")
+	}
+}
+
+func TestHostSendRemoteAndRunPushTarCompressed(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript(makeTestBundle(t))
+	assert(err)
+	job := newTestJob(script, nil)
+	job.Push = pushTar
+	job.Compress = true
+	if err = host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(host.Output) != 3 || host.Output[0] != "link -> hello" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestHostSendRemoteAndRunPushTarCorrupt(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript(makeTestBundle(t))
+	assert(err)
+	bundle, err := script.Bundle(false)
+	assert(err)
+	bundle.Sum++
+	job := newTestJob(script, nil)
+	job.Push = pushTar
+	if err = host.SendRemoteAndRun(job); err == nil {
+		t.Error("corrupt bundle accepted")
+	}
+	if len(host.Output) != 0 {
+		t.Error("output:", host.Output)
+	}
+}
+
+func TestHostSendRemoteAndRunStaged(t *testing.T) {
+	for _, push := range []string{pushCopy, pushTar} {
+		dir := makeTestBundle(t)
+		script, err := NewScript(dir)
+		assert(err)
+		job := newTestJob(script, nil)
+		job.Push = push
+		host := newLocalHost(t, "localhost")
+		if err = host.SendRemoteAndRun(job); err != nil {
+			t.Error(push, err)
+			continue
+		}
+		assert(os.Remove(path.Join(dir, "link")))
+		host = newLocalHost(t, "localhost")
+		if err = host.SendRemoteAndRun(job); err != nil {
+			t.Error(push, err)
+			continue
+		}
+		if len(host.Output) != 3 || host.Output[0] != "link -> hello" {
+			t.Error(push, "output:", host.Output)
+		}
+		job.Cleanup()
+	}
+}
+
+func TestHostSendRemoteAndRunTrailingSlash(t *testing.T) {
+	for _, c := range []struct {
+		push      string
+		bootstrap bool
+	}{{pushCopy, false}, {pushTar, false}, {pushCopy, true}} {
+		script, err := NewScript("examples/bootstrap/")
+		assert(err)
+		job := newTestJob(script, nil)
+		job.Push = c.push
+		job.Bootstrap = c.bootstrap
+		host := newLocalHost(t, "localhost")
+		if err = host.SendRemoteAndRun(job); err != nil {
+			t.Error(c.push, c.bootstrap, err)
+		} else if len(host.Output) != 3 || host.Output[2] != "My data: 0xCAFEBABE" {
+			t.Error(c.push, c.bootstrap, "output:", host.Output)
+		}
+		job.Cleanup()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How many lines at the top of a group script are searched for
+// "# judo: key=value" directives.
+const scriptDirectiveLines = 10
+
+// ScriptCache keeps the output of group scripts on the local disk,
+// so that slow scripts don't have to run on every invocation.
+type ScriptCache struct {
+	// Dir is where the cached output is kept.
+	Dir string
+	// TTL is how long cached output is good for, unless a script
+	// says otherwise; zero disables caching.
+	TTL time.Duration
+	// Refresh forces running the scripts, ignoring any cached output.
+	Refresh bool
+}
+
+// NewScriptCache creates a ScriptCache in the user's cache directory,
+// with caching disabled by default.
+func NewScriptCache() *ScriptCache {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return &ScriptCache{Dir: path.Join(dir, "judo", "inventory")}
+}
+
+// TTLFor returns the cache TTL for the named group script. A script
+// can set its own with a "# judo: cache=10m" line near the top.
+func (cache *ScriptCache) TTLFor(fname string) (time.Duration, error) {
+	value, ok := readScriptDirectives(fname)["cache"]
+	if !ok {
+		return cache.TTL, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("bad cache directive: %s", err)
+	}
+	return ttl, nil
+}
+
+// Load returns the cached output of the named group script, and
+// whether it is younger than ttl.
+func (cache *ScriptCache) Load(fname string, ttl time.Duration) (
+	lines []string, fresh bool, err error) {
+	cname := cache.path(fname)
+	stat, err := os.Stat(cname)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := os.ReadFile(cname)
+	if err != nil {
+		return nil, false, err
+	}
+	lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	return lines, time.Since(stat.ModTime()) < ttl, nil
+}
+
+// Store saves the output of the named group script.
+func (cache *ScriptCache) Store(fname string, lines []string) error {
+	if err := os.MkdirAll(cache.Dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(cache.Dir, "tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join(lines, "\n") + "\n")
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cache.path(fname))
+}
+
+// path returns the name of the cache file for the named script.
+func (cache *ScriptCache) path(fname string) string {
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		abs = fname
+	}
+	return path.Join(cache.Dir, fmt.Sprintf("%x", sha256.Sum256([]byte(abs))))
+}
+
+// readScriptDirectives collects "# judo: key=value ..." directives
+// from the top of the named script.
+func readScriptDirectives(fname string) map[string]string {
+	directives := make(map[string]string)
+	f, err := os.Open(fname)
+	if err != nil {
+		return directives
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i := 0; i < scriptDirectiveLines && scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		if !strings.HasPrefix(line, "judo:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "judo:")) {
+			elems := strings.SplitN(field, "=", 2)
+			if len(elems) == 2 {
+				directives[elems[0]] = elems[1]
+			} else {
+				directives[elems[0]] = ""
+			}
+		}
+	}
+	return directives
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptCacheTTLFor(t *testing.T) {
+	dir := t.TempDir()
+	fname := path.Join(dir, "script")
+	assert(os.WriteFile(
+		fname, []byte("#!/bin/sh\n# judo: cache=10m\necho foo\n"), 0755))
+	cache := &ScriptCache{Dir: dir, TTL: time.Minute}
+	ttl, err := cache.TTLFor(fname)
+	if err != nil || ttl != 10*time.Minute {
+		t.Error("ttl:", ttl, err)
+	}
+	assert(os.WriteFile(fname, []byte("#!/bin/sh\necho foo\n"), 0755))
+	ttl, err = cache.TTLFor(fname)
+	if err != nil || ttl != time.Minute {
+		t.Error("default ttl:", ttl, err)
+	}
+}
+
+func TestScriptCacheStoreLoad(t *testing.T) {
+	cache := &ScriptCache{Dir: path.Join(t.TempDir(), "cache")}
+	assert(cache.Store("groups/foo", []string{"a", "b"}))
+	lines, fresh, err := cache.Load("groups/foo", time.Minute)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !fresh || strings.Join(lines, " ") != "a b" {
+		t.Error("lines:", lines, fresh)
+	}
+	_, fresh, _ = cache.Load("groups/foo", 0)
+	if fresh {
+		t.Error("expected stale")
+	}
+}
+
+func TestInventoryScriptOutputStaleFallback(t *testing.T) {
+	dir := t.TempDir()
+	fname := path.Join(dir, "script")
+	assert(os.WriteFile(
+		fname, []byte("#!/bin/sh\n# judo: cache=1ns\nexit 1\n"), 0755))
+	inventory := NewInventory()
+	inventory.logger = &NilLogger{}
+	inventory.Cache.Dir = path.Join(dir, "cache")
+	if _, err := inventory.scriptOutput(fname); err == nil {
+		t.Error("expected error without cache")
+	}
+	assert(inventory.Cache.Store(fname, []string{"stale"}))
+	lines, err := inventory.scriptOutput(fname)
+	if err != nil || len(lines) != 1 || lines[0] != "stale" {
+		t.Error("lines:", lines, err)
+	}
+}
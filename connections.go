@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Connection is a persistent SSH master, started by one judo run, and
+// reused by the following ones until it's been idle for Persist. A
+// record of each is kept in the state directory.
+type Connection struct {
+	Name    string        `json:"name"`
+	Address string        `json:"address"`
+	Args    []string      `json:"args"`
+	Started time.Time     `json:"started"`
+	Persist time.Duration `json:"persist"`
+}
+
+func connectionStateName(name string) string {
+	return path.Join("connections", name+".json")
+}
+
+// LoadConnections reads the records of all persistent masters, in
+// order of host name.
+func LoadConnections() ([]*Connection, error) {
+	entries, err := os.ReadDir(path.Join(stateDir(), "connections"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var conns []*Connection
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		conn := &Connection{}
+		err = readState(connectionStateName(strings.TrimSuffix(name, ".json")), conn)
+		if err != nil {
+			return nil, err
+		}
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Name < conns[j].Name
+	})
+	return conns, nil
+}
+
+// control sends the given control command (e.g. "check" or "exit")
+// to the master.
+func (conn *Connection) control(command string) error {
+	args := append([]string{}, conn.Args...)
+	args = append(args, "-O", command, conn.Address)
+	return exec.Command("ssh", args...).Run()
+}
+
+// Alive reports whether the master is still running.
+func (conn *Connection) Alive() bool {
+	return conn.control("check") == nil
+}
+
+// forget removes the record of the master.
+func (conn *Connection) forget() error {
+	err := os.Remove(path.Join(stateDir(), connectionStateName(conn.Name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ListConnections reports the persistent masters that are still
+// running; records of those that are gone are removed.
+func ListConnections() (string, error) {
+	conns, err := LoadConnections()
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, conn := range conns {
+		if !conn.Alive() {
+			if err = conn.forget(); err != nil {
+				return "", err
+			}
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(
+			"%s: connected since %s, persists for %s when idle",
+			conn.Name, conn.Started.Format(time.RFC3339), conn.Persist,
+		))
+	}
+	if len(lines) == 0 {
+		return "No connections", nil
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// Disconnect tears down the persistent masters of the named hosts, or
+// all of them if no names are given.
+func Disconnect(names []string) (string, error) {
+	conns, err := LoadConnections()
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, conn := range conns {
+		if len(names) > 0 && !contains(names, conn.Name) {
+			continue
+		}
+		if conn.Alive() {
+			if err = conn.control("exit"); err != nil {
+				return "", fmt.Errorf("%s: %s", conn.Name, err)
+			}
+			lines = append(lines, "Disconnected: "+conn.Name)
+		}
+		if err = conn.forget(); err != nil {
+			return "", err
+		}
+	}
+	if len(lines) == 0 {
+		return "No connections", nil
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// connectPersistent makes sure a persistent master is running for the
+// host, starting one if needed, and records it in the state
+// directory.
+func (t *sshTransport) connectPersistent(job *Job) error {
+	host := t.host
+	conn := &Connection{
+		Name:    host.Name,
+		Address: host.Address,
+		Args:    t.controlArgs(job),
+		Persist: job.Persist,
+	}
+	t.persistent = true
+	if conn.Alive() {
+		debugLogger.Printf("%s: reusing master", host.Name)
+		t.connected = true
+		return nil
+	}
+	if err := host.waitToConnect(job); err != nil {
+		return err
+	}
+	args := append([]string{}, conn.Args...)
+	args = append(args,
+		"-o", "ControlMaster=yes",
+		"-o", fmt.Sprintf("ControlPersist=%d", int(job.Persist.Seconds())),
+		"-fN", host.Address,
+	)
+	proc, err := NewProc("ssh", args...)
+	if err != nil {
+		return err
+	}
+	if err = host.follow(job, proc); err != nil {
+		return err
+	}
+	if err = t.waitReady(job, nil); err != nil {
+		return err
+	}
+	t.connected = true
+	conn.Started = time.Now()
+	return writeState(connectionStateName(host.Name), conn)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func writeTestConnection(t *testing.T, name string) *Connection {
+	conn := &Connection{
+		Name:    name,
+		Address: name,
+		Args: []string{
+			"-o", "ControlPath=" + path.Join(t.TempDir(), "nonexistent"),
+		},
+		Started: time.Now(),
+		Persist: 10 * time.Minute,
+	}
+	assert(writeState(connectionStateName(name), conn))
+	return conn
+}
+
+func TestLoadConnections(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	conns, err := LoadConnections()
+	if err != nil || len(conns) != 0 {
+		t.Error("unexpected connections:", conns, err)
+	}
+	writeTestConnection(t, "web2")
+	writeTestConnection(t, "web1")
+	conns, err = LoadConnections()
+	assert(err)
+	if len(conns) != 2 || conns[0].Name != "web1" || conns[1].Name != "web2" {
+		t.Error("connections:", conns)
+	}
+	if conns[0].Persist != 10*time.Minute {
+		t.Error("persist:", conns[0].Persist)
+	}
+}
+
+func TestListConnectionsPrunesDead(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	writeTestConnection(t, "web1")
+	msg, err := ListConnections()
+	assert(err)
+	if msg != "No connections" {
+		t.Error("msg:", msg)
+	}
+	conns, err := LoadConnections()
+	assert(err)
+	if len(conns) != 0 {
+		t.Error("dead connection kept:", conns)
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	writeTestConnection(t, "web1")
+	writeTestConnection(t, "web2")
+	_, err := Disconnect([]string{"web2"})
+	assert(err)
+	conns, err := LoadConnections()
+	assert(err)
+	if len(conns) != 1 || conns[0].Name != "web1" {
+		t.Error("connections:", conns)
+	}
+	_, err = Disconnect(nil)
+	assert(err)
+	conns, err = LoadConnections()
+	assert(err)
+	if len(conns) != 0 {
+		t.Error("connections:", conns)
+	}
+}
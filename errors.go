@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"strings"
 )
 
 // ErrorTimeout Operation has timed out
@@ -9,3 +10,44 @@ var ErrorTimeout = errors.New("Operation timed out")
 
 // ErrorCancel Operation was canceled while pending
 var ErrorCancel = errors.New("Operation canceled")
+
+// ErrorPending Operation was canceled while waiting to connect
+var ErrorPending = errors.New("Canceled while waiting to connect")
+
+// Warning is the result of a host that ran into problems worth
+// telling about along the way, e.g. its master connection couldn't be
+// set up. Err is nil if the host got the job done nonetheless.
+type Warning struct {
+	Warnings []string
+	Err      error
+}
+
+func (w *Warning) Error() string {
+	if w.Err != nil {
+		return w.Err.Error()
+	}
+	return strings.Join(w.Warnings, "; ")
+}
+
+func (w *Warning) Unwrap() error {
+	return w.Err
+}
+
+// Failed tells whether a host's result is a failure: any error but a
+// Warning of a host that got the job done.
+func Failed(err error) bool {
+	var w *Warning
+	if errors.As(err, &w) {
+		return w.Err != nil
+	}
+	return err != nil
+}
+
+// Warnings returns the warnings carried by a host's result.
+func Warnings(err error) []string {
+	var w *Warning
+	if errors.As(err, &w) {
+		return w.Warnings
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// execTransport reaches the host through arbitrary commands, e.g. to
+// run inside containers or chroots. It is configured with two command
+// templates, taken from the host's vars:
+//
+//	judo_exec=docker exec -i {host} --
+//	judo_copy=docker cp {src} {host}:{dst}
+//
+// The exec template is followed by "sh -c COMMAND"; {host} expands to
+// the host's address, {src} and {dst} to the local and remote paths.
+type execTransport struct {
+	host *Host
+}
+
+func newExecTransport(host *Host) (*execTransport, error) {
+	for _, key := range []string{"judo_exec", "judo_copy"} {
+		if host.Vars[key] == "" {
+			return nil, fmt.Errorf("exec transport needs %s", key)
+		}
+	}
+	return &execTransport{host: host}, nil
+}
+
+// expand splits the named template into words, and fills in the
+// placeholders.
+func (t *execTransport) expand(key string, src string, dst string) ([]string, error) {
+	words, err := splitFields(t.host.Vars[key])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", key, err)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%s: empty template", key)
+	}
+	r := strings.NewReplacer(
+		"{host}", t.host.Address,
+		"{src}", src,
+		"{dst}", dst,
+	)
+	for i := range words {
+		words[i] = r.Replace(words[i])
+	}
+	return words, nil
+}
+
+// Connect does nothing.
+func (t *execTransport) Connect(job *Job) error {
+	return nil
+}
+
+// Run runs the command line through the exec template.
+func (t *execTransport) Run(job *Job, cmdline string, stdin io.Reader) (*Proc, error) {
+	words, err := t.expand("judo_exec", "", "")
+	if err != nil {
+		return nil, err
+	}
+	words = append(words, "sh", "-c", cmdline)
+	if stdin != nil {
+		return NewProcInput(stdin, words[0], words[1:]...)
+	}
+	return NewProc(words[0], words[1:]...)
+}
+
+// Push copies files through the copy template.
+func (t *execTransport) Push(job *Job, local string, remote string) (*Proc, error) {
+	words, err := t.expand("judo_copy", local, remote)
+	if err != nil {
+		return nil, err
+	}
+	return NewProc(words[0], words[1:]...)
+}
+
+// Close does nothing.
+func (t *execTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newExecHost(t *testing.T, name string) *Host {
+	t.Setenv("HOME", t.TempDir())
+	host, err := NewHost(name)
+	assert(err)
+	host.logger.SetOutput(&strings.Builder{})
+	host.Vars["judo_transport"] = "exec"
+	host.Vars["judo_exec"] = "env JUDO_TEST_TARGET={host}"
+	host.Vars["judo_copy"] = "cp -R {src} {dst}"
+	assert(host.SetTransport(""))
+	return host
+}
+
+func TestExecTransportMissingTemplate(t *testing.T) {
+	host, err := NewHost("box")
+	assert(err)
+	host.Vars["judo_transport"] = "exec"
+	if err := host.SetTransport(""); err == nil {
+		t.Error("accepted exec transport without templates")
+	}
+}
+
+func TestExecTransportRun(t *testing.T) {
+	host := newExecHost(t, "box")
+	job := newTestJob(nil, NewCommand(`echo "$JUDO_TEST_TARGET"`))
+	if err := host.RunRemote(job); err != nil {
+		t.Error(err)
+	}
+	if strings.Join(host.Output, "\n") != "box" {
+		t.Error("output:", host.Output)
+	}
+}
+
+func TestExecTransportSendRemoteAndRun(t *testing.T) {
+	host := newExecHost(t, "box")
+	script, err := NewScript("examples/bootstrap")
+	assert(err)
+	if err = host.SendRemoteAndRun(newTestJob(script, nil)); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(host.Output) != 3 || host.Output[0] != "Bootstrapping box!" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestExecTransportMissingTemplateFailsHost(t *testing.T) {
+	job := newTestJob(nil, NewCommand("true"))
+	job.Transport = "exec"
+	assert(job.PopulateInventory([]string{"box"}))
+	for host, err := range *job.Execute() {
+		if err == nil || err.Error() != "exec transport needs judo_exec" {
+			t.Error(host.Name, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// factsProbe is the shell snippet run on each host to gather facts.
+// It asks uname(1), falling back on what the kernel publishes in /proc,
+// and otherwise relies on the shell's builtins, reading /proc and
+// /etc/os-release; facts that aren't there stay empty.
+const factsProbe = `
+get() {
+	[ -r "$2" ] && read -r value < "$2" && echo "$1=$value"
+}
+uname_or_get() {
+	value=$(uname "$2" 2>/dev/null) && [ -n "$value" ] &&
+		echo "$1=$value" || get "$1" "$3"
+}
+uname_or_get kernel -s /proc/sys/kernel/ostype
+uname_or_get kernel_release -r /proc/sys/kernel/osrelease
+uname_or_get arch -m /proc/sys/kernel/arch
+if [ -r /proc/cpuinfo ]; then
+	cpus=0
+	while read -r key rest; do
+		case $key in
+			processor) cpus=$((cpus + 1)) ;;
+		esac
+	done </proc/cpuinfo
+	echo "cpus=$cpus"
+fi
+if [ -r /etc/os-release ]; then
+	while IFS='=' read -r key value; do
+		value=${value#\"}
+		value=${value%\"}
+		case $key in
+			ID) echo "os=$value" ;;
+			VERSION_ID) echo "os_version=$value" ;;
+		esac
+	done </etc/os-release
+fi
+if [ -r /proc/meminfo ]; then
+	while read -r key value unit; do
+		case $key in
+			MemTotal:) echo "memory_kb=$value" ;;
+		esac
+	done </proc/meminfo
+fi
+true
+`
+
+// Facts describe a host, as reported by the facts probe.
+type Facts map[string]string
+
+// factsState is how facts are stored in the state directory.
+type factsState struct {
+	Gathered time.Time `json:"gathered"`
+	Facts    Facts     `json:"facts"`
+}
+
+// parseFacts reads the key=value lines printed by the facts probe.
+func parseFacts(lines []string) Facts {
+	facts := make(Facts)
+	for _, line := range lines {
+		elems := strings.SplitN(line, "=", 2)
+		if len(elems) != 2 || elems[0] == "" {
+			continue
+		}
+		facts[elems[0]] = strings.TrimSpace(elems[1])
+	}
+	return facts
+}
+
+// Env returns the facts as JUDO_FACT_* environment variables.
+func (facts Facts) Env() map[string]string {
+	env := make(map[string]string)
+	for key, value := range facts {
+		name := "JUDO_FACT_" + strings.ToUpper(key)
+		if envName.MatchString(name) {
+			env[name] = value
+		}
+	}
+	return env
+}
+
+// String formats the facts as sorted key=value pairs.
+func (facts Facts) String() string {
+	var pairs []string
+	for key, value := range facts {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// FactFilter selects hosts whose facts have the given values.
+type FactFilter map[string]string
+
+// ParseFactFilter parses a filter like "os=debian,arch=arm64".
+func ParseFactFilter(s string) (FactFilter, error) {
+	filter := make(FactFilter)
+	for _, pair := range strings.Split(s, ",") {
+		elems := strings.SplitN(pair, "=", 2)
+		if len(elems) != 2 || elems[0] == "" {
+			return nil, fmt.Errorf("bad filter, expected key=value: %s", pair)
+		}
+		filter[elems[0]] = elems[1]
+	}
+	return filter, nil
+}
+
+// Match reports whether the facts satisfy the filter.
+func (filter FactFilter) Match(facts Facts) bool {
+	for key, value := range filter {
+		if have, ok := facts[key]; !ok || have != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Missing returns the keys of the filter that the facts lack, e.g.
+// because they were never gathered, or the host didn't report them.
+func (filter FactFilter) Missing(facts Facts) (keys []string) {
+	for key := range filter {
+		if _, ok := facts[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func factsStateName(name string) string {
+	return path.Join("facts", name+".json")
+}
+
+// LoadFacts returns the facts last gathered from the named host, if
+// any.
+func LoadFacts(name string) (Facts, error) {
+	var state factsState
+	if err := readState(factsStateName(name), &state); err != nil {
+		return nil, err
+	}
+	return state.Facts, nil
+}
+
+// GatherFacts runs the facts probe on the host, and stores the facts
+// in the state directory.
+func (host *Host) GatherFacts(job *Job) error {
+	lines, err := host.ExecReadLines(job, factsProbe)
+	if err != nil {
+		return err
+	}
+	host.Facts = parseFacts(lines)
+	host.logger.Println(host.Facts)
+	return writeState(factsStateName(host.Name), factsState{
+		Gathered: time.Now(),
+		Facts:    host.Facts,
+	})
+}
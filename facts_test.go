@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestFactsProbe(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	assert(err)
+	// uname(1) comes first; without it, the probe needs nothing but
+	// the shell, and /proc
+	for _, env := range [][]string{nil, {"PATH=/nonexistent"}} {
+		cmd := exec.Command(sh, "-c", factsProbe)
+		cmd.Env = env
+		out, err := cmd.Output()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		facts := parseFacts(strings.Split(string(out), "\n"))
+		keys := []string{
+			"kernel", "kernel_release", "os", "cpus", "memory_kb",
+		}
+		if env == nil {
+			keys = append(keys, "arch")
+		}
+		for _, key := range keys {
+			if facts[key] == "" {
+				t.Error("missing fact:", key, env)
+			}
+		}
+		if facts["cpus"] == "0" {
+			t.Error("no cpus")
+		}
+	}
+}
+
+func TestParseFacts(t *testing.T) {
+	facts := parseFacts([]string{"os=debian", "garbage", "=x", "cpus=4 "})
+	if len(facts) != 2 || facts["os"] != "debian" || facts["cpus"] != "4" {
+		t.Error("facts:", facts)
+	}
+	env := facts.Env()
+	if env["JUDO_FACT_OS"] != "debian" || env["JUDO_FACT_CPUS"] != "4" {
+		t.Error("env:", env)
+	}
+}
+
+func TestFactFilter(t *testing.T) {
+	filter, err := ParseFactFilter("os=debian,arch=arm64")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !filter.Match(Facts{"os": "debian", "arch": "arm64", "cpus": "4"}) {
+		t.Error("expected match")
+	}
+	if filter.Match(Facts{"os": "debian", "arch": "amd64"}) {
+		t.Error("unexpected match")
+	}
+	if filter.Match(nil) {
+		t.Error("matched no facts")
+	}
+	missing := filter.Missing(Facts{"os": "debian"})
+	if len(missing) != 1 || missing[0] != "arch" {
+		t.Error("missing:", missing)
+	}
+	if _, err = ParseFactFilter("os"); err == nil {
+		t.Error("accepted bad filter")
+	}
+}
+
+func TestFactsState(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	if _, err := LoadFacts("web1"); err == nil {
+		t.Error("facts out of nowhere")
+	}
+	assert(writeState(factsStateName("web1"), factsState{
+		Facts: Facts{"os": "debian"},
+	}))
+	facts, err := LoadFacts("web1")
+	if err != nil || facts["os"] != "debian" {
+		t.Error("facts:", facts, err)
+	}
+}
+
+func TestJobSelectHostsUnknown(t *testing.T) {
+	job := newTestJob(nil, NewCommand("true"))
+	assert(job.Inventory.Populate([]string{"web1", "web2", "web3"}))
+	job.Inventory.hosts[0].Facts = Facts{"os": "debian", "arch": "arm64"}
+	job.Inventory.hosts[1].Facts = Facts{"os": "debian", "arch": "amd64"}
+	job.Inventory.hosts[2].Facts = Facts{"os": "debian"}
+	job.Where = FactFilter{"arch": "arm64"}
+	unknown := job.SelectHosts()
+	if len(unknown) != 1 || unknown[0].Name != "web3" {
+		t.Error("unknown:", unknown)
+	}
+	if len(job.Inventory.hosts) != 1 || job.Inventory.hosts[0].Name != "web1" {
+		t.Error("hosts:", job.Inventory.hosts)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// workdirMarker is the file in every workdir that says which run
+// created it, and when: "RUN-ID UNIX-TIME".
+const workdirMarker = ".judo-run"
+
+const defaultOlderThan = 7 * 24 * time.Hour
+
+// gcScript removes workdirs started before the given time (2). In
+// the host's own remote directory (3), workdirs without a marker (left
+// by older versions of judo, or just being created) are removed too,
+// if they haven't been modified for more than the given number of
+// days (5), as find(1) counts them; without find(1), they're left
+// alone. Elsewhere (4), they may not be judo's, and are left alone.
+// It prints each workdir removed.
+const gcScript = `
+gc() {
+	for w in "$1"/tmp.*; do
+		[ -d "$w" ] || continue
+		run=- started=0
+		if [ -f "$w/%[1]s" ]; then
+			read -r run started < "$w/%[1]s"
+			[ "$started" -le %[2]d ] 2> /dev/null || continue
+		elif [ "$2" = fallback ]; then
+			continue
+		elif [ -z "$(find "$w" -prune -mtime +%[5]d 2> /dev/null)" ]; then
+			continue
+		fi
+		rm -r "$w" && echo "removed $started $run $w"
+	done
+}
+gc %[3]s own
+for b in %[4]s; do gc "$b" fallback; done
+`
+
+// newRunID returns a random ID for a run of judo.
+func newRunID() string {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
+	assert(err)
+	return fmt.Sprintf("%x", b)
+}
+
+// markerCommand returns the shell command that marks the workdir
+// (named by the given shell expression) as the job's.
+func markerCommand(job *Job, workdir string) string {
+	return fmt.Sprintf(`echo %s %d > %s/%s`,
+		job.RunID, time.Now().Unix(), workdir, workdirMarker)
+}
+
+// ParseAge parses a duration like time.ParseDuration does, also
+// accepting days, e.g. "7d".
+func ParseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("bad age: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// gcCommand returns the shell command that removes the host's stale
+// workdirs.
+func (host *Host) gcCommand(job *Job) string {
+	cutoff := time.Now().Add(-job.OlderThan).Unix()
+	return fmt.Sprintf(gcScript,
+		workdirMarker, cutoff, host.remoteDir(job), workdirFallbacks,
+		mtimeDays(job.OlderThan))
+}
+
+// mtimeDays returns the N for "find -mtime +N" that matches files
+// older than the given age, rounded up to whole days: find(1) counts
+// only whole days, and "+N" means more than N of them.
+func mtimeDays(age time.Duration) int {
+	day := 24 * time.Hour
+	days := int((age + day - 1) / day)
+	if days < 1 {
+		return 0
+	}
+	return days - 1
+}
+
+// logRemoved logs the workdirs reported removed by gcScript, and
+// returns the other lines.
+func (host *Host) logRemoved(lines []string) (rest []string) {
+	for _, line := range lines {
+		elems := strings.SplitN(line, " ", 4)
+		if len(elems) != 4 || elems[0] != "removed" {
+			rest = append(rest, line)
+			continue
+		}
+		started := "unknown"
+		if n, err := strconv.ParseInt(elems[1], 10, 64); err == nil && n > 0 {
+			started = time.Unix(n, 0).Format(time.RFC3339)
+		}
+		host.logger.Printf("removed %s (run %s, started %s)",
+			elems[3], elems[2], started)
+	}
+	return
+}
+
+// GC removes the host's stale workdirs.
+func (host *Host) GC(job *Job) error {
+	lines, err := host.ExecReadLines(job, host.gcCommand(job))
+	host.logRemoved(lines)
+	return err
+}
+
+// GCHosts removes stale workdirs from all hosts.
+func (job *Job) GCHosts() *JobResult {
+	return job.each(func(host *Host) error {
+		return host.GC(job)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	for s, expect := range map[string]time.Duration{
+		"7d":  7 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+		"0d":  0,
+	} {
+		if age, err := ParseAge(s); err != nil || age != expect {
+			t.Errorf("%s: %s, %v", s, age, err)
+		}
+	}
+	for _, s := range []string{"d", "-1d", "week"} {
+		if _, err := ParseAge(s); err == nil {
+			t.Errorf("%s: accepted", s)
+		}
+	}
+}
+
+// makeStaleWorkdir creates a workdir in dir, marked as started age
+// ago, or without a marker if age is negative.
+func makeStaleWorkdir(t *testing.T, dir, name string, age time.Duration) string {
+	w := path.Join(dir, name)
+	assert(os.MkdirAll(w, 0700))
+	if age >= 0 {
+		started := time.Now().Add(-age).Unix()
+		assert(os.WriteFile(path.Join(w, workdirMarker),
+			[]byte(fmt.Sprintf("abc123 %d\n", started)), 0644))
+	}
+	return w
+}
+
+// makeUnmarkedWorkdir creates a workdir in dir without a marker, last
+// modified age ago.
+func makeUnmarkedWorkdir(t *testing.T, dir, name string, age time.Duration) string {
+	w := makeStaleWorkdir(t, dir, name, -1)
+	mtime := time.Now().Add(-age)
+	assert(os.Chtimes(w, mtime, mtime))
+	return w
+}
+
+func TestMtimeDays(t *testing.T) {
+	for age, expect := range map[time.Duration]int{
+		0:                  0,
+		12 * time.Hour:     0,
+		24 * time.Hour:     0,
+		7 * 24 * time.Hour: 6,
+		7*24*time.Hour + 1: 7,
+	} {
+		if days := mtimeDays(age); days != expect {
+			t.Errorf("%s: %d", age, days)
+		}
+	}
+}
+
+func TestHostGC(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	var logs strings.Builder
+	host.logger.SetOutput(&logs)
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	own := path.Join(os.Getenv("HOME"), ".judo")
+	stale := []string{
+		makeStaleWorkdir(t, own, "tmp.old", 8*24*time.Hour),
+		makeUnmarkedWorkdir(t, own, "tmp.unmarked", 8*24*time.Hour),
+		makeStaleWorkdir(t, tmp, "tmp.old", 8*24*time.Hour),
+	}
+	fresh := []string{
+		makeStaleWorkdir(t, own, "tmp.new", time.Hour),
+		// e.g. a run started by an older judo, or one that's just
+		// about to write its marker
+		makeUnmarkedWorkdir(t, own, "tmp.busy", time.Hour),
+		makeStaleWorkdir(t, own, "cache", -1),
+		makeStaleWorkdir(t, tmp, "tmp.unmarked", -1),
+		makeStaleWorkdir(t, tmp, "tmp.new", time.Hour),
+	}
+	job := newTestJob(nil, nil)
+	if err := host.GC(job); err != nil {
+		t.Error(err)
+		return
+	}
+	for _, w := range stale {
+		if _, err := os.Stat(w); err == nil {
+			t.Error("not removed:", w)
+		}
+		if !strings.Contains(logs.String(), "removed "+w+" ") {
+			t.Error("not listed:", w)
+		}
+	}
+	for _, w := range fresh {
+		if _, err := os.Stat(w); err != nil {
+			t.Error("removed:", w)
+		}
+	}
+	if !strings.Contains(logs.String(), "(run abc123, started ") {
+		t.Error("logs:", logs.String())
+	}
+}
+
+func TestHostPrune(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	own := path.Join(os.Getenv("HOME"), ".judo")
+	old := makeStaleWorkdir(t, own, "tmp.old", 8*24*time.Hour)
+	job := newTestJob(writeTestScript(t, "cat \"$HOME\"/.judo/tmp.*/.judo-run\n"), nil)
+	job.Prune = true
+	if err := host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := os.Stat(old); err == nil {
+		t.Error("not pruned:", old)
+	}
+	if len(host.Output) != 1 ||
+		!strings.HasPrefix(host.Output[0], job.RunID+" ") {
+		t.Error("marker:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
@@ -5,49 +5,119 @@ import (
 	"log"
 	"os"
 	"path"
+	"regexp"
+	"strings"
 )
 
-// Host represents a single host (invocation target)
+var envName = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// Host represents a single host (invocation target). Name is used for
+// display, and as HOSTNAME; Address, User and Port say how to connect.
+// KeptWorkdir is the remote workdir left behind for inspection, if any.
 type Host struct {
-	Name    string
-	Env     map[string]string
-	SshArgs []string
-	groups  []string
-	workdir string
-	cancel  chan bool
-	master  *Proc
-	logger  *log.Logger
+	Name        string
+	Address     string
+	User        string
+	Port        int
+	Env         map[string]string
+	Vars        map[string]string
+	Facts       Facts
+	Output      []string
+	Warnings    []string
+	KeptWorkdir string
+	SshArgs     []string
+	groups      []string
+	workdir     string
+	cancel      chan bool
+	logger      *log.Logger
+
+	transport Transport
+	recording bool
 }
 
-// NewHost creates a new Host struct with default values.
-func NewHost(name string) (host *Host) {
+// NewHost creates a new Host struct with default values. The name is
+// parsed as a Target.
+func NewHost(name string) (host *Host, err error) {
+	target, err := ParseTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	name = target.Name
 	env := make(map[string]string)
 	env["HOSTNAME"] = name
-	return &Host{
+	host = &Host{
 		Name:    name,
+		Address: target.Address,
+		User:    target.User,
+		Port:    target.Port,
 		Env:     env,
+		Vars:    make(map[string]string),
 		SshArgs: []string{},
 		groups:  []string{},
 		cancel:  make(chan bool),
-		master:  nil,
 		logger:  log.New(os.Stderr, fmt.Sprintf("%s: ", name), 0),
 	}
+	host.transport = &sshTransport{host: host}
+	return host, nil
+}
+
+// Environment returns the remote environment for this host: the
+// host's facts (as JUDO_FACT_*), and the inventory vars, overridden
+// by Env. Judo's own settings (judo_*), Ansible's connection vars
+// (ansible_*), and vars that can't be environment variable names, are
+// left out.
+func (host *Host) Environment() map[string]string {
+	env := host.Facts.Env()
+	for key, value := range host.Vars {
+		if strings.HasPrefix(key, "judo_") ||
+			strings.HasPrefix(key, "ansible_") ||
+			!envName.MatchString(key) {
+			continue
+		}
+		env[key] = value
+	}
+	for key, value := range host.Env {
+		env[key] = value
+	}
+	return env
+}
+
+// SetTransport picks the transport for this host: the one named by
+// the judo_transport var, "local" if Ansible's ansible_connection var
+// says so, or the given default. If the transport can't be set up,
+// the host fails with the same error when it's used.
+func (host *Host) SetTransport(name string) (err error) {
+	if v, ok := host.Vars["judo_transport"]; ok {
+		name = v
+	} else if host.Vars["ansible_connection"] == "local" {
+		name = "local"
+	}
+	host.transport, err = NewTransport(name, host)
+	if err != nil {
+		host.transport = &failedTransport{err}
+	}
+	return
 }
 
 // SendRemoteAndRun establishes a connection to the host, sends off
 // and executes the given job, and returns any possible resulting
 // error.
 func (host *Host) SendRemoteAndRun(job *Job) (err error) {
+	if job.Bootstrap {
+		return host.Bootstrap(job)
+	}
+
 	// speedify!
-	host.StartMaster()
+	if err = host.transport.Connect(job); err != nil {
+		return err
+	}
 
 	// deferred functions are called first in, last out.
 	// any other defers can still use the master to clean up remote.
-	defer host.StopMaster()
+	defer host.transport.Close()
 
 	// make cozy
-	err = host.SSH(job, `mkdir -p "$HOME/.judo"`)
-	workdir, err := host.SSHRead(job, `TMPDIR="$HOME/.judo" mktemp -d`)
+	workdir, err := host.makeWorkdir(job)
 	if err != nil {
 		return err
 	}
@@ -55,10 +125,10 @@ func (host *Host) SendRemoteAndRun(job *Job) (err error) {
 
 	cleanup := func() error {
 		host.workdir = ""
-		return host.SSH(job, fmt.Sprintf("rm -r %s", shquote(workdir)))
+		return host.Exec(job, fmt.Sprintf("rm -r %s", shquote(workdir)))
 	}
 
-	// ensure cleanup
+	// ensure cleanup, unless the workdir is to be kept
 	defer func() {
 		if err := recover(); err != nil {
 			// oops! clean up remote
@@ -66,6 +136,15 @@ func (host *Host) SendRemoteAndRun(job *Job) (err error) {
 			// continue panicking
 			panic(err)
 		}
+		if job.KeepWorkdir == keepAlways ||
+			job.KeepWorkdir == keepOnFailure && err != nil {
+			host.workdir = ""
+			host.KeptWorkdir = workdir
+			return
+		}
+		if errCleanup := cleanup(); err == nil {
+			err = errCleanup
+		}
 	}()
 
 	// Figure out the correct path for the remote script
@@ -83,7 +162,7 @@ func (host *Host) SendRemoteAndRun(job *Job) (err error) {
 	}
 
 	// Create remote directory structure
-	if err = host.SSH(
+	if err = host.Exec(
 		job,
 		fmt.Sprintf("mkdir -p %s", shquote(remoteScriptDir)),
 	); err != nil {
@@ -92,9 +171,8 @@ func (host *Host) SendRemoteAndRun(job *Job) (err error) {
 
 	// push files to remote
 	if job.Script.dirmode {
-		if err = host.pushFiles(
+		if err = host.pushScript(
 			job,
-			job.Script.fname,
 			// We need to strip one level of path, otherwise
 			// scp will duplicate it. Eh...
 			path.Dir(remoteScriptDir),
@@ -102,9 +180,8 @@ func (host *Host) SendRemoteAndRun(job *Job) (err error) {
 			return err
 		}
 	} else {
-		if err = host.pushFiles(
+		if err = host.pushScript(
 			job,
-			job.Script.fname,
 			remoteScriptDir,
 		); err != nil {
 			return err
@@ -123,19 +200,27 @@ func (host *Host) SendRemoteAndRun(job *Job) (err error) {
 	}
 
 	// do the actual work
-	errJob := host.SSH(job, remoteCommand)
+	return host.runJob(job, remoteCommand)
+}
 
-	// clean up
-	if err = cleanup(); err != nil {
+// RunRemote establishes a connection to the host, and runs the job's
+// command there.
+func (host *Host) RunRemote(job *Job) (err error) {
+	if err = host.transport.Connect(job); err != nil {
 		return err
 	}
-	return errJob
+	defer host.transport.Close()
+	return host.runJob(job, job.Command.cmd)
 }
 
-// RunRemote runs the given job on the host, assuming the connection
-// has been already established, and job files copied over.
-func (host *Host) RunRemote(job *Job) (err error) {
-	return host.SSH(job, job.Command.cmd)
+// runJob executes the main command of the job; if the job records
+// output, the command's output is recorded in Output.
+func (host *Host) runJob(job *Job, command string) error {
+	host.recording = job.recordsOutput()
+	defer func() {
+		host.recording = false
+	}()
+	return host.Exec(job, command)
 }
 
 // Cancel execution of code on the remote end.
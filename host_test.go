@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLocalHost(t *testing.T, name string) *Host {
+	t.Setenv("HOME", t.TempDir())
+	host, err := NewHost(name)
+	assert(err)
+	host.logger.SetOutput(&strings.Builder{})
+	assert(host.SetTransport("local"))
+	return host
+}
+
+func newTestJob(script *Script, command *Command) *Job {
+	job := NewJob(NewInventory(), script, command,
+		map[string]string{}, []string{}, 10*time.Second)
+	job.record = true
+	return job
+}
+
+func assertNoWorkdirs(t *testing.T) {
+	entries, err := os.ReadDir(path.Join(os.Getenv("HOME"), ".judo"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(entries) != 0 {
+		t.Error("workdir left behind:", entries[0].Name())
+	}
+}
+
+func TestHostSendRemoteAndRunLocal(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript("examples/hello.sh")
+	assert(err)
+	if err = host.SendRemoteAndRun(newTestJob(script, nil)); err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Join(host.Output, "\n") != "Hello from localhost!" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestHostSendRemoteAndRunLocalDirMode(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript("examples/bootstrap")
+	assert(err)
+	if err = host.SendRemoteAndRun(newTestJob(script, nil)); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(host.Output) != 3 || host.Output[2] != "My data: 0xCAFEBABE" {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
+
+func TestHostRunRemoteLocal(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	host.Vars["GREETING"] = "hi"
+	host.Env["EXTRA"] = "it's quoted"
+	job := newTestJob(nil, NewCommand(`echo "$GREETING $HOSTNAME $EXTRA"; exit 3`))
+	if err := host.RunRemote(job); err == nil {
+		t.Error("exit status lost")
+	}
+	if strings.Join(host.Output, "\n") != "hi localhost it's quoted" {
+		t.Error("output:", host.Output)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Host key policies.
+const (
+	// hostKeysStrict only accepts known host keys.
+	hostKeysStrict = "strict"
+	// hostKeysAcceptNew adds keys of new hosts to judo's known_hosts.
+	hostKeysAcceptNew = "accept-new"
+	// hostKeysPinned only accepts the keys in a given file (judo's
+	// known_hosts by default); the user's known_hosts are ignored.
+	hostKeysPinned = "pinned"
+)
+
+// knownHostsFile returns the path of judo's own known_hosts file,
+// filled by --fetch-host-keys.
+func knownHostsFile() string {
+	return path.Join(stateDir(), "known_hosts")
+}
+
+// hostKeyArgs returns the ssh(1)/scp(1) options for the given host
+// key policy: "strict", "accept-new", "pinned" or "pinned=FILE"; and
+// whether judo's known_hosts should be consulted, before the files
+// ssh(1) would consult anyway (see knownHostsArgs). With no policy,
+// that's only if judo's known_hosts exists.
+func hostKeyArgs(policy string) (args []string, known bool, err error) {
+	name, fname := policy, knownHostsFile()
+	if i := strings.Index(policy, "="); i >= 0 {
+		name, fname = policy[:i], policy[i+1:]
+		if name != hostKeysPinned || fname == "" {
+			return nil, false, argumentError{Message: "--host-keys " + policy}
+		}
+	}
+	switch name {
+	case "":
+		_, err = os.Stat(fname)
+		return nil, err == nil, nil
+	case hostKeysStrict:
+		return []string{"-o", "StrictHostKeyChecking=yes"}, true, nil
+	case hostKeysAcceptNew:
+		// ssh(1) creates the file, but not the directory
+		if err = os.MkdirAll(path.Dir(fname), 0700); err != nil {
+			return nil, false, err
+		}
+		return []string{"-o", "StrictHostKeyChecking=accept-new"}, true, nil
+	case hostKeysPinned:
+		return []string{
+			"-o", "UserKnownHostsFile=" + quoteConfigPath(fname),
+			"-o", "GlobalKnownHostsFile=/dev/null",
+			"-o", "StrictHostKeyChecking=yes",
+		}, false, nil
+	}
+	return nil, false, argumentError{Message: "--host-keys " + policy}
+}
+
+// quoteConfigPath quotes a path for an ssh(1) option, if it needs it.
+func quoteConfigPath(fname string) string {
+	if strings.ContainsAny(fname, " \t\"") {
+		return strconv.Quote(fname)
+	}
+	return fname
+}
+
+// knownHostsArgs returns the ssh(1) option that puts judo's
+// known_hosts in front of the files ssh(1) would consult for the host
+// anyway, as set by ssh_config, "-F" or "-o" options. If ssh(1) can't
+// tell, the files are ssh(1)'s defaults. ("ssh -G" doesn't quote the
+// paths it prints, so those are passed on as they are.)
+func (host *Host) knownHostsArgs() []string {
+	files := []string{quoteConfigPath(knownHostsFile())}
+	values, err := host.sshConfigValues()
+	if err == nil && values["userknownhostsfile"] != "" {
+		files = append(files, values["userknownhostsfile"])
+	} else {
+		files = append(files, "~/.ssh/known_hosts", "~/.ssh/known_hosts2")
+	}
+	return []string{"-o", "UserKnownHostsFile=" + strings.Join(files, " ")}
+}
+
+// HostKey is a public key of a host, as found in known_hosts. Marker
+// is "@cert-authority" or "@revoked", if the line has one.
+type HostKey struct {
+	Marker  string
+	Host    string
+	Type    string
+	Key     string
+	Comment string
+}
+
+// String formats the key as a known_hosts line.
+func (key HostKey) String() string {
+	fields := []string{key.Host, key.Type, key.Key}
+	if key.Marker != "" {
+		fields = append([]string{key.Marker}, fields...)
+	}
+	if key.Comment != "" {
+		fields = append(fields, key.Comment)
+	}
+	return strings.Join(fields, " ")
+}
+
+// Fingerprint returns the key's SHA256 fingerprint, as shown by
+// ssh(1) and ssh-keygen(1).
+func (key HostKey) Fingerprint() (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(key.Key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]), nil
+}
+
+// parseHostKey parses a known_hosts line; ok is false for blank lines
+// and comments.
+func parseHostKey(line string) (key HostKey, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return key, false, nil
+	}
+	if strings.HasPrefix(fields[0], "@") {
+		key.Marker, fields = fields[0], fields[1:]
+	}
+	if len(fields) < 3 {
+		return key, false, fmt.Errorf("malformed host key: %s", line)
+	}
+	key.Host, key.Type, key.Key = fields[0], fields[1], fields[2]
+	key.Comment = strings.Join(fields[3:], " ")
+	return key, true, nil
+}
+
+// readHostKeys parses known_hosts lines, skipping comments.
+func readHostKeys(r io.Reader) (keys []HostKey, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, ok, err := parseHostKey(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// matchKnownHost tells whether a host pattern from known_hosts (one
+// of the comma-separated ones, possibly hashed) is exactly the name.
+func matchKnownHost(pattern string, name string) bool {
+	if !strings.HasPrefix(pattern, "|1|") {
+		return pattern == name
+	}
+	parts := strings.Split(pattern[len("|1|"):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	sum, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), sum)
+}
+
+// sshConfigValues asks ssh(1) how it would connect to the host, with
+// all options, ssh_config and inventory vars taken into account.
+func (host *Host) sshConfigValues() (map[string]string, error) {
+	args := host.connectArgs()
+	args = append(args, host.SshArgs...)
+	args = append(args, "-G", host.Address)
+	out, err := exec.Command("ssh", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		elems := strings.SplitN(line, " ", 2)
+		if len(elems) == 2 {
+			values[elems[0]] = elems[1]
+		}
+	}
+	return values, nil
+}
+
+// ScanHostKeys collects the host's public keys with ssh-keyscan(1),
+// named the way ssh(1) will look them up. Hosts behind a ProxyJump or
+// ProxyCommand are out of ssh-keyscan(1)'s reach; see scanThroughSSH.
+func (host *Host) ScanHostKeys(job *Job) ([]HostKey, error) {
+	values, err := host.sshConfigValues()
+	if err != nil {
+		return nil, err
+	}
+	var keys []HostKey
+	if isSet(values["proxyjump"]) || isSet(values["proxycommand"]) {
+		keys, err = host.scanThroughSSH(job)
+	} else {
+		keys, err = host.scanDirect(job, values)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys found")
+	}
+	return keys, nil
+}
+
+// isSet tells whether an ssh_config value is set to something.
+func isSet(value string) bool {
+	return value != "" && value != "none"
+}
+
+// scanDirect collects the host's keys with ssh-keyscan(1), given how
+// ssh(1) would connect to it.
+func (host *Host) scanDirect(job *Job, values map[string]string) ([]HostKey, error) {
+	hostname, port := values["hostname"], values["port"]
+	if hostname == "" {
+		hostname = host.Address
+	}
+	if port == "" {
+		port = "22"
+	}
+	timeout := int(job.Timeout.Seconds())
+	if timeout < 1 {
+		timeout = 1
+	}
+	cmd := exec.Command("ssh-keyscan",
+		"-T", strconv.Itoa(timeout), "-p", port, hostname)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := readHostKeys(strings.NewReader(string(out)))
+	if err != nil {
+		return nil, err
+	}
+	if alias := values["hostkeyalias"]; isSet(alias) {
+		for i := range keys {
+			keys[i].Host = alias
+		}
+	}
+	return keys, nil
+}
+
+// scanThroughSSH collects the host's keys by connecting with ssh(1),
+// through whatever proxies it's configured with, into an empty,
+// throwaway known_hosts, which ssh(1) fills in with the keys it's
+// shown, named the way it looks them up. Logging in isn't needed, but
+// if it works, ssh(1) asks for the rest of the host's keys, too.
+func (host *Host) scanThroughSSH(job *Job) ([]HostKey, error) {
+	dir, err := os.MkdirTemp("", "judo.")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "known_hosts")
+	var args []string
+	if job.Timeout > 0 {
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d",
+			(job.Timeout+time.Second-1)/time.Second))
+	}
+	args = append(args,
+		"-o", "UserKnownHostsFile="+quoteConfigPath(fname),
+		"-o", "GlobalKnownHostsFile=/dev/null",
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "HashKnownHosts=no",
+		"-o", "UpdateHostKeys=yes",
+		"-o", "ControlPath=none",
+		sshBatchOpt,
+	)
+	args = append(args, host.connectArgs()...)
+	args = append(args, host.SshArgs...)
+	args = append(args, host.Address, "true")
+	// the exit status tells nothing about the keys
+	exec.Command("ssh", args...).Run()
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readHostKeys(f)
+}
+
+// FetchHostKeys collects the keys of all hosts, shows their
+// fingerprints on out, and asks (on in) for approval to add them to
+// judo's known_hosts, replacing any keys it had for the same names.
+func (job *Job) FetchHostKeys(in io.Reader, out io.Writer) (*JobResult, error) {
+	var m sync.Mutex
+	scanned := make(map[*Host][]HostKey)
+	result := job.each(func(host *Host) error {
+		keys, err := host.ScanHostKeys(job)
+		m.Lock()
+		scanned[host] = keys
+		m.Unlock()
+		return err
+	})
+	var keys []HostKey
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tNAME\tTYPE\tFINGERPRINT")
+	for host := range job.GetHosts() {
+		for _, key := range scanned[host] {
+			fingerprint, err := key.Fingerprint()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", host.Name, err)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", host.Name, key.Host, key.Type, fingerprint)
+			keys = append(keys, key)
+		}
+	}
+	w.Flush()
+	if len(keys) == 0 {
+		return result, nil
+	}
+	fmt.Fprintf(out, "Add these keys to %s? [y/N] ", knownHostsFile())
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if answer != "y" && answer != "yes" {
+		fmt.Fprintln(out, "Not saved")
+		for host := range *result {
+			if !Failed((*result)[host]) {
+				(*result)[host] = fmt.Errorf("host keys not approved")
+			}
+		}
+		return result, nil
+	}
+	return result, addKnownHosts(knownHostsFile(), keys)
+}
+
+// addKnownHosts adds the keys to the named known_hosts file, replacing
+// any keys it had for the same names, hashed or not. Names are taken
+// out of lines that list others too; @cert-authority and @revoked
+// lines, comments, and anything else, are left as they were.
+func addKnownHosts(fname string, keys []HostKey) error {
+	var names []string
+	for _, key := range keys {
+		names = append(names, key.Host)
+	}
+	var lines []string
+	b, err := os.ReadFile(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		key, ok, err := parseHostKey(line)
+		if err != nil {
+			return err
+		}
+		if !ok || key.Marker != "" {
+			if line != "" || len(lines) > 0 {
+				lines = append(lines, line)
+			}
+			continue
+		}
+		var kept []string
+		for _, pattern := range strings.Split(key.Host, ",") {
+			if !matchAnyKnownHost(pattern, names) {
+				kept = append(kept, pattern)
+			}
+		}
+		switch {
+		case len(kept) == 0:
+		case len(kept) < strings.Count(key.Host, ",")+1:
+			lines = append(lines, strings.Replace(
+				line, key.Host, strings.Join(kept, ","), 1))
+		default:
+			lines = append(lines, line)
+		}
+	}
+	for _, key := range keys {
+		lines = append(lines, key.String())
+	}
+	if err = os.MkdirAll(path.Dir(fname), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(fname, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// matchAnyKnownHost tells whether the known_hosts host pattern is any
+// of the names.
+func matchAnyKnownHost(pattern string, names []string) bool {
+	for _, name := range names {
+		if matchKnownHost(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testHostKey = "ssh-ed25519 " +
+	"AAAAC3NzaC1lZDI1NTE5AAAAIFMmyaFSG7VXgf/yZGLx2EP6fDebwVbfonDstBle/U4j"
+
+func TestHostKeyFingerprint(t *testing.T) {
+	keys, err := readHostKeys(strings.NewReader(
+		"# web1:22 SSH-2.0-OpenSSH\nweb1 " + testHostKey + "\n"))
+	assert(err)
+	if len(keys) != 1 || keys[0].Host != "web1" || keys[0].Type != "ssh-ed25519" {
+		t.Error("keys:", keys)
+		return
+	}
+	fingerprint, err := keys[0].Fingerprint()
+	assert(err)
+	if fingerprint != "SHA256:2fiQObtDK1QpFprkgIJp1PqBLsvBTBmyc7JEqV5lo8Y" {
+		t.Error("fingerprint:", fingerprint)
+	}
+}
+
+func TestHostKeyArgs(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	args, known, err := hostKeyArgs("")
+	if err != nil || len(args) != 0 || known {
+		t.Error("args without known_hosts:", args, known, err)
+	}
+	args, known, err = hostKeyArgs("accept-new")
+	assert(err)
+	if !known || strings.Join(args, " ") != "-o StrictHostKeyChecking=accept-new" {
+		t.Error("accept-new:", args, known)
+	}
+	args, known, err = hostKeyArgs("")
+	if err != nil || len(args) != 0 || known {
+		t.Error("args with an empty state dir:", args, known, err)
+	}
+	args, known, err = hostKeyArgs("pinned=/etc/judo keys/known_hosts")
+	assert(err)
+	if known || strings.Join(args, " ") !=
+		`-o UserKnownHostsFile="/etc/judo keys/known_hosts" `+
+			"-o GlobalKnownHostsFile=/dev/null -o StrictHostKeyChecking=yes" {
+		t.Error("pinned:", args)
+	}
+	for _, policy := range []string{"yolo", "strict=foo", "pinned="} {
+		if _, _, err = hostKeyArgs(policy); err == nil {
+			t.Error("accepted:", policy)
+		}
+	}
+}
+
+func TestHostKnownHostsArgs(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", path.Join(t.TempDir(), "my state"))
+	bin := t.TempDir()
+	assert(os.WriteFile(path.Join(bin, "ssh"), []byte(
+		"#!/bin/sh\necho userknownhostsfile /etc/ssh/fleet_hosts\n"), 0755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	host, err := NewHost("web1")
+	assert(err)
+	args := strings.Join(host.knownHostsArgs(), " ")
+	if args != `-o UserKnownHostsFile="`+knownHostsFile()+`" /etc/ssh/fleet_hosts` {
+		t.Error("args:", args)
+	}
+}
+
+func TestAddKnownHosts(t *testing.T) {
+	fname := path.Join(t.TempDir(), "known_hosts")
+	// web4, hashed
+	hashed := "|1|8NVi6jtH0/jz9Q1lSWU/dF1pTDs=|nkASlGN+NxEMuLhYL+vJrJkBiI8="
+	assert(os.WriteFile(fname, []byte("# fleet\n"+
+		"web1 ssh-rsa AAAA\n"+
+		"web2,10.0.0.2 ssh-rsa BBBB\n"+
+		"@cert-authority *.example.com ssh-rsa EEEE ca@example.com\n"+
+		"@revoked web2 ssh-rsa FFFF\n"+
+		hashed+" ssh-rsa GGGG\n"), 0600))
+	if !matchKnownHost(hashed, "web4") {
+		t.Fatal("hashed name not matched")
+	}
+	assert(addKnownHosts(fname, []HostKey{
+		{Host: "web2", Type: "ssh-ed25519", Key: "CCCC"},
+		{Host: "web3", Type: "ssh-ed25519", Key: "DDDD"},
+		{Host: "web4", Type: "ssh-ed25519", Key: "HHHH"},
+	}))
+	b, err := os.ReadFile(fname)
+	assert(err)
+	if string(b) != "# fleet\n"+
+		"web1 ssh-rsa AAAA\n"+
+		"10.0.0.2 ssh-rsa BBBB\n"+
+		"@cert-authority *.example.com ssh-rsa EEEE ca@example.com\n"+
+		"@revoked web2 ssh-rsa FFFF\n"+
+		"web2 ssh-ed25519 CCCC\n"+
+		"web3 ssh-ed25519 DDDD\n"+
+		"web4 ssh-ed25519 HHHH\n" {
+		t.Error("known_hosts:\n" + string(b))
+	}
+}
+
+func TestJobFetchHostKeys(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	bin := t.TempDir()
+	assert(os.WriteFile(path.Join(bin, "ssh"), []byte(
+		"#!/bin/sh\necho hostname 10.0.0.1\necho port 2222\n"), 0755))
+	assert(os.WriteFile(path.Join(bin, "ssh-keyscan"), []byte(
+		"#!/bin/sh\necho \"# comment\" >&2\necho \"[10.0.0.1]:2222 "+
+			testHostKey+"\"\n"), 0755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	for _, answer := range []string{"n\n", "y\n"} {
+		job := newTestJob(nil, nil)
+		job.Inventory.Populate([]string{"web1"})
+		var out strings.Builder
+		result, err := job.FetchHostKeys(strings.NewReader(answer), &out)
+		assert(err)
+		if !strings.Contains(out.String(),
+			"web1  [10.0.0.1]:2222  ssh-ed25519  SHA256:2fiQObtDK1") {
+			t.Error("output:\n" + out.String())
+		}
+		_, err = os.Stat(knownHostsFile())
+		if answer == "n\n" {
+			if result.ExitStatus() == 0 || err == nil {
+				t.Error("saved without approval")
+			}
+		} else if result.ExitStatus() != 0 || err != nil {
+			t.Error("not saved:", err)
+		}
+	}
+}
+
+func TestJobFetchHostKeysProxyJump(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	bin := t.TempDir()
+	// ssh(1) that's configured with a ProxyJump, and records the key
+	// it's shown in the known_hosts it's given
+	assert(os.WriteFile(path.Join(bin, "ssh"), []byte(`#!/bin/sh
+for a; do
+	case "$a" in
+	-G) echo "proxyjump bastion"; exit ;;
+	UserKnownHostsFile=*) known="${a#UserKnownHostsFile=}" ;;
+	esac
+done
+echo "web1 `+testHostKey+`" > "$known"
+exit 255
+`), 0755))
+	assert(os.WriteFile(path.Join(bin, "ssh-keyscan"), []byte(
+		"#!/bin/sh\nexit 1\n"), 0755))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	job := newTestJob(nil, nil)
+	job.Inventory.Populate([]string{"web1"})
+	var out strings.Builder
+	result, err := job.FetchHostKeys(strings.NewReader("y\n"), &out)
+	assert(err)
+	if result.ExitStatus() != 0 ||
+		!strings.Contains(out.String(), "web1  web1  ssh-ed25519  SHA256:2fiQObtDK1") {
+		t.Error("output:\n" + out.String())
+	}
+}
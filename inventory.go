@@ -2,31 +2,54 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
 var inventoryLine = regexp.MustCompile("^[^# ]+")
 
-// Inventory is a collection of managed hosts.
+// Inventory is a collection of managed hosts. Group scripts are run
+// concurrently, at most Jobs at a time, each for at most Timeout.
+// Names starting with "@sshconfig" refer to the hosts declared in
+// the SSHConfig file. Group files are looked up in the "groups"
+// directory inside Dir (default: the current directory).
 type Inventory struct {
-	hosts   []*Host
-	s       *SeenString
-	Timeout time.Duration
-	logger  Logger
+	hosts     []*Host
+	s         *SeenString
+	targets   map[string]Target
+	Timeout   time.Duration
+	Jobs      int
+	Dir       string
+	File      *InventoryFile
+	Cache     *ScriptCache
+	SSHConfig string
+	sshConfig *InventoryFile
+	vars      map[string]map[string]string
+	m         *sync.Mutex
+	jobs      chan bool
+	logger    Logger
 }
 
 // NewInventory creates a new Inventory.
 func NewInventory() *Inventory {
 	return &Inventory{
-		hosts:   []*Host{},
-		s:       NewSeenString(),
-		Timeout: time.Duration(30) * time.Second,
-		logger:  log.New(os.Stderr, "inventory: ", 0),
+		hosts:     []*Host{},
+		s:         NewSeenString(),
+		targets:   make(map[string]Target),
+		Timeout:   time.Duration(30) * time.Second,
+		Jobs:      8,
+		Cache:     NewScriptCache(),
+		SSHConfig: defaultSSHConfig(),
+		vars:      make(map[string]map[string]string),
+		m:         &sync.Mutex{},
+		logger:    log.New(os.Stderr, "inventory: ", 0),
 	}
 }
 
@@ -35,13 +58,36 @@ func NewInventory() *Inventory {
 // e.g. if you have a group named "foo" with hosts "a" and "b" in it,
 // the inventory will be populated with hosts "a" and "b". If the
 // hosts already exist in the inventory, they will be updated to
-// reflect group membership.
-func (inventory *Inventory) Populate(names []string) {
-	for _, name := range names {
-		for host := range inventory.resolveNames(name) {
-			inventory.hosts = append(inventory.hosts, host)
+// reflect group membership. Hosts pick up their vars from the
+// inventory file, if there is one, and from group scripts.
+//
+// Names are resolved concurrently, but hosts end up in the inventory
+// in the order they were named, regardless of which group finished
+// resolving first.
+func (inventory *Inventory) Populate(names []string) error {
+	hosts, err := inventory.resolveNames(names...)
+	if err != nil {
+		return err
+	}
+	inventory.hosts = append(inventory.hosts, hosts...)
+	return nil
+}
+
+// Select narrows down the inventory to the given selection of hosts.
+func (inventory *Inventory) Select(sel *Selection) {
+	inventory.hosts = sel.Apply(inventory.hosts)
+}
+
+// Filter narrows down the inventory to hosts for which keep returns
+// true.
+func (inventory *Inventory) Filter(keep func(host *Host) bool) {
+	var hosts []*Host
+	for _, host := range inventory.hosts {
+		if keep(host) {
+			hosts = append(hosts, host)
 		}
 	}
+	inventory.hosts = hosts
 }
 
 // GetHosts iterates over all hosts in the inventory.
@@ -74,72 +120,246 @@ func readGroups(r io.Reader) (out []string) {
 	return
 }
 
-func (inventory *Inventory) readGroupsFromScript(fname string, ch chan *Host) {
-	proc, err := NewProc(fname)
-	assert(err)
+func (inventory *Inventory) readGroupsFromScript(fname string) ([]string, error) {
+	var names []string
+	lines, err := inventory.scriptOutput(fname)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	if isAnsibleList(lines) {
+		file, err := ReadAnsibleList(
+			strings.NewReader(strings.Join(lines, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fname, err)
+		}
+		names = file.AllHosts()
+		for _, name := range names {
+			inventory.addDynamicVars(name, file.HostVars(name))
+		}
+	} else {
+		names = readGroups(strings.NewReader(strings.Join(lines, "\n")))
+	}
+	return inventory.resolveAll(names)
+}
+
+// scriptOutput returns the output of the named group script, taking
+// it from the cache if allowed. If the script fails, stale cached
+// output is used instead, if there is any.
+func (inventory *Inventory) scriptOutput(fname string) ([]string, error) {
+	cache := inventory.Cache
+	ttl, err := cache.TTLFor(fname)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 && !cache.Refresh {
+		lines, fresh, err := cache.Load(fname, ttl)
+		if err == nil && fresh {
+			debugLogger.Printf("%s: using cached output", fname)
+			return lines, nil
+		}
+	}
+	inventory.acquireJob()
+	lines, err := inventory.runGroupScript(fname)
+	inventory.releaseJob()
+	if err != nil {
+		stale, _, errCache := cache.Load(fname, ttl)
+		if ttl == 0 || errCache != nil {
+			return nil, err
+		}
+		inventory.logger.Printf(
+			"%s: %s; falling back to cached output", fname, err)
+		return stale, nil
+	}
+	if ttl > 0 {
+		if err = cache.Store(fname, lines); err != nil {
+			inventory.logger.Printf("%s: can't cache output: %s", fname, err)
+		}
+	}
+	return lines, nil
+}
+
+// runGroupScript executes the named group script, and returns its
+// output. Scripts with a "# judo: ansible" directive are invoked with
+// "--list", like Ansible would; others without arguments.
+func (inventory *Inventory) runGroupScript(fname string) (lines []string, err error) {
+	var args []string
+	if _, ok := readScriptDirectives(fname)["ansible"]; ok {
+		args = append(args, "--list")
+	}
+	proc, err := NewProc(fname, args...)
+	if err != nil {
+		return nil, err
+	}
 	close(proc.Stdin())
+	timeout := time.After(inventory.Timeout)
 	for {
 		select {
 		case line, ok := <-proc.Stdout():
-			name := inventoryLine.FindString(line)
-			if !ok || name == "" {
+			if !ok {
 				continue
 			}
-			for host := range inventory.resolveNames(name) {
-				ch <- host
-			}
+			lines = append(lines, line)
 		case line, ok := <-proc.Stderr():
 			if !ok {
 				continue
 			}
 			inventory.logger.Print(line)
 		case err = <-proc.Done():
-			assert(err)
-			return
-		case <-time.After(inventory.Timeout):
-			panic(ErrorTimeout)
+			return lines, err
+		case <-timeout:
+			if proc.IsAlive() {
+				proc.Signal(os.Kill)
+			}
+			return nil, ErrorTimeout
+		}
+	}
+}
+
+// addDynamicVars records vars reported for the named host by a group
+// script.
+func (inventory *Inventory) addDynamicVars(name string, vars map[string]string) {
+	inventory.m.Lock()
+	defer inventory.m.Unlock()
+	if inventory.vars[name] == nil {
+		inventory.vars[name] = make(map[string]string)
+	}
+	for key, value := range vars {
+		inventory.vars[name][key] = value
+	}
+}
+
+// hostVars returns the vars for the named host: those from the
+// inventory file, overridden by those reported by group scripts.
+func (inventory *Inventory) hostVars(name string) map[string]string {
+	vars := make(map[string]string)
+	if inventory.File != nil {
+		vars = inventory.File.HostVars(name)
+	}
+	inventory.m.Lock()
+	defer inventory.m.Unlock()
+	for key, value := range inventory.vars[name] {
+		vars[key] = value
+	}
+	return vars
+}
+
+// acquireJob waits until another group script is allowed to run.
+func (inventory *Inventory) acquireJob() {
+	inventory.m.Lock()
+	if inventory.jobs == nil {
+		jobs := inventory.Jobs
+		if jobs < 1 {
+			jobs = 1
 		}
+		inventory.jobs = make(chan bool, jobs)
 	}
+	jobs := inventory.jobs
+	inventory.m.Unlock()
+	jobs <- true
 }
 
-func (inventory *Inventory) readGroupsFromFile(fname string, ch chan *Host) {
+// releaseJob lets another group script run.
+func (inventory *Inventory) releaseJob() {
+	<-inventory.jobs
+}
+
+func (inventory *Inventory) readGroupsFromFile(fname string) ([]string, error) {
 	f, err := os.Open(fname)
-	assert(err)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
-	for _, name := range readGroups(f) {
-		for host := range inventory.resolveNames(name) {
-			ch <- host
+	return inventory.resolveAll(readGroups(f))
+}
+
+func (inventory *Inventory) readGroupsFromInventoryFile(name string) ([]string, error) {
+	group := inventory.File.Groups[name]
+	var names []string
+	names = append(names, group.Hosts...)
+	names = append(names, group.Children...)
+	return inventory.resolveAll(names)
+}
+
+// resolveAll resolves the given names concurrently, and returns the
+// host names they refer to, in order. The result may contain
+// duplicates. The first name that can't be resolved, in order, fails
+// them all.
+func (inventory *Inventory) resolveAll(names []string) ([]string, error) {
+	results := make([][]string, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i], errs[i] = inventory.resolve(name)
+		}(i, name)
+	}
+	wg.Wait()
+	var out []string
+	for i := range names {
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
+		out = append(out, results[i]...)
 	}
+	return out, nil
 }
 
-func (inventory *Inventory) resolveNames(name string) (ch chan *Host) {
-	ch = make(chan *Host)
-	fname := path.Join("groups", name)
+// resolve returns the host names the given name refers to, in order.
+func (inventory *Inventory) resolve(name string) ([]string, error) {
+	if strings.HasPrefix(name, sshConfigPrefix) {
+		return inventory.sshConfigHosts(name)
+	}
+
+	fname := path.Join(inventory.Dir, "groups", name)
 	stat, err := os.Stat(fname)
 
+	if err != nil && inventory.File != nil && inventory.File.HasGroup(name) {
+		return inventory.readGroupsFromInventoryFile(name)
+	}
+
 	if err != nil {
-		go func() {
-			if !inventory.s.SeenBefore(name) {
-				ch <- NewHost(name)
-			}
-			close(ch)
-		}()
-		return
+		return []string{name}, nil
 	}
 
 	if !stat.Mode().IsRegular() {
-		close(ch)
-		panic("not regular file")
+		return nil, fmt.Errorf("%s: not a regular file", fname)
 	}
-	go func() {
-		defer close(ch)
-		if isExecutable(stat.Mode()) {
-			inventory.readGroupsFromScript(fname, ch)
-		} else {
-			inventory.readGroupsFromFile(fname, ch)
-		}
+	if isExecutable(stat.Mode()) {
+		return inventory.readGroupsFromScript(fname)
+	}
+	return inventory.readGroupsFromFile(fname)
+}
 
-	}()
-	return
+// resolveNames resolves the given names into the hosts they refer
+// to, in order. Hosts that were seen before, under any name that
+// reaches the same address, user and port, are skipped. Each host
+// picks up its vars under the name the inventory wrote it as, e.g.
+// "web1:2222", which is not necessarily its display name.
+func (inventory *Inventory) resolveNames(names ...string) (hosts []*Host, err error) {
+	resolved, err := inventory.resolveAll(names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range resolved {
+		if inventory.s.SeenBefore(name) {
+			continue
+		}
+		target, err := ParseTarget(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := inventory.targets[target.Name]; ok {
+			continue
+		}
+		inventory.targets[target.Name] = target
+		host, err := NewHost(name)
+		if err != nil {
+			return nil, err
+		}
+		host.Vars = inventory.hostVars(name)
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
 }
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"os"
+	"path"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestInventory_resolveNames(t *testing.T) {
 	inventory := NewInventory()
-	for host := range inventory.resolveNames("test") {
+	hosts, err := inventory.resolveNames("test")
+	if err != nil || len(hosts) != 1 {
+		t.Error("no host:", err)
+		return
+	}
+	for _, host := range hosts {
 		if host.Name != "test" {
 			t.Error("no host")
 			return
@@ -86,3 +94,167 @@ test2 garbage
 		}
 	}
 }
+
+func TestInventoryPopulateAnsibleScript(t *testing.T) {
+	dir := t.TempDir()
+	assert(os.Mkdir(path.Join(dir, "groups"), 0755))
+	assert(os.WriteFile(
+		path.Join(dir, "groups/dynamic"),
+		[]byte("#!/bin/sh\n# judo: ansible\n[ \"$1\" = --list ] || exit 1\n"+
+			"cat <<'EOF'\n"+testAnsibleList+"\nEOF\n"),
+		0755,
+	))
+
+	inventory := NewInventory()
+	inventory.Dir = dir
+	inventory.Populate([]string{"dynamic"})
+	hosts := make(map[string]*Host)
+	for host := range inventory.GetHosts() {
+		hosts[host.Name] = host
+	}
+	if len(hosts) != 2 {
+		t.Error("hosts:", hosts)
+		return
+	}
+	if hosts["web1"].Vars["ansible_host"] != "10.0.0.1" {
+		t.Error("vars:", hosts["web1"].Vars)
+	}
+	if _, has := hosts["web1"].Environment()["ansible_host"]; has {
+		t.Error("connection var leaked into environment")
+	}
+	if hosts["web1"].Environment()["AZ"] != "eu-west-1a" {
+		t.Error("environment:", hosts["web1"].Environment())
+	}
+}
+
+func TestSshArgsFromVars(t *testing.T) {
+	args := sshArgsFromVars(map[string]string{
+		"ansible_host": "10.0.0.1",
+		"ansible_port": "2222",
+		"FOO":          "bar",
+	})
+	if strings.Join(args, " ") != "-o HostName=10.0.0.1 -o Port=2222" {
+		t.Error("args:", args)
+	}
+}
+
+func TestSshArgsFromVarsOrder(t *testing.T) {
+	args := sshArgsFromVars(map[string]string{
+		"ansible_port":        "2222",
+		"ansible_user":        "ansible",
+		"judo_ssh_port":       "22",
+		"judo_ssh_proxy_jump": "bastion",
+		"judo_ssh_options":    "ServerAliveInterval=15 Compression=yes",
+	})
+	expect := "-o Port=22 -o ProxyJump=bastion " +
+		"-o ServerAliveInterval=15 -o Compression=yes " +
+		"-o Port=2222 -o User=ansible"
+	if strings.Join(args, " ") != expect {
+		t.Error("args:", args)
+	}
+}
+
+func TestInventoryHostSshArgs(t *testing.T) {
+	file, err := ReadInventoryJSON(strings.NewReader(`{
+		"groups": {
+			"dmz": {
+				"hosts": ["web1", "web2"],
+				"vars": {"judo_ssh_proxy_jump": "bastion"}
+			}
+		},
+		"hosts": {"web2": {"judo_ssh_proxy_jump": "none"}}
+	}`))
+	assert(err)
+	inventory := NewInventory()
+	inventory.File = file
+	job := NewJob(inventory, nil, NewCommand("true"), map[string]string{},
+		[]string{"-o", "ProxyJump=cli"}, time.Second)
+	job.PopulateInventory([]string{"dmz"})
+	var args []string
+	for host := range job.GetHosts() {
+		args = append(args, strings.Join(host.SshArgs, " "))
+	}
+	if len(args) != 2 ||
+		args[0] != "-o ProxyJump=bastion -o ProxyJump=cli" ||
+		args[1] != "-o ProxyJump=none -o ProxyJump=cli" {
+		t.Error("args:", args)
+	}
+}
+
+func TestInventoryPopulateConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	assert(os.Mkdir(path.Join(dir, "groups"), 0755))
+	assert(os.WriteFile(
+		path.Join(dir, "groups/slow"),
+		[]byte("#!/bin/sh\nsleep 1\necho a\necho b\n"), 0755))
+	assert(os.WriteFile(
+		path.Join(dir, "groups/fast"),
+		// line-based scripts are invoked without arguments
+		[]byte("#!/bin/sh\n[ $# -eq 0 ] || exit 1\necho c\necho a\n"), 0755))
+	assert(os.WriteFile(
+		path.Join(dir, "groups/slower"),
+		[]byte("#!/bin/sh\nsleep 1\necho d\n"), 0755))
+
+	inventory := NewInventory()
+	inventory.Dir = dir
+	start := time.Now()
+	inventory.Populate([]string{"slow", "fast", "slower"})
+	if elapsed := time.Since(start); elapsed > 1900*time.Millisecond {
+		t.Error("scripts did not run concurrently:", elapsed)
+	}
+	var names []string
+	for host := range inventory.GetHosts() {
+		names = append(names, host.Name)
+	}
+	if strings.Join(names, " ") != "a b c d" {
+		t.Error("hosts:", names)
+	}
+}
+
+func TestInventoryPopulateSameHost(t *testing.T) {
+	inventory := NewInventory()
+	if err := inventory.Populate([]string{"web1", "ssh://web1", "web1"}); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(inventory.hosts) != 1 {
+		t.Error("hosts:", len(inventory.hosts))
+	}
+	if err := inventory.Populate([]string{"root@web1", "deploy@web1"}); err != nil {
+		t.Error(err)
+		return
+	}
+	var names []string
+	for host := range inventory.GetHosts() {
+		names = append(names, host.Name)
+	}
+	if strings.Join(names, " ") != "web1 root@web1 deploy@web1" {
+		t.Error("hosts:", names)
+	}
+}
+
+func TestInventoryPopulateTargetVars(t *testing.T) {
+	file, err := ReadInventoryJSON(strings.NewReader(
+		`{"hosts": {"web1:2222": {"FOO": "bar"}}}`))
+	assert(err)
+	inventory := NewInventory()
+	inventory.File = file
+	assert(inventory.Populate([]string{"web1:2222"}))
+	for host := range inventory.GetHosts() {
+		if host.Vars["FOO"] != "bar" {
+			t.Error("vars:", host.Name, host.Vars)
+		}
+	}
+}
+
+func TestInventoryPopulateMalformed(t *testing.T) {
+	dir := t.TempDir()
+	assert(os.Mkdir(path.Join(dir, "groups"), 0755))
+	assert(os.WriteFile(
+		path.Join(dir, "groups/web"), []byte("web1\n@web2\n"), 0644))
+	inventory := NewInventory()
+	inventory.Dir = dir
+	if err := inventory.Populate([]string{"web"}); err == nil {
+		t.Error("malformed target accepted")
+	}
+}
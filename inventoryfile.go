@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Default names of the structured inventory file, looked up in the
+// current directory, next to "groups/".
+var inventoryFileNames = []string{"inventory.json", "inventory.ini"}
+
+// InventoryGroup is a single group declared in an InventoryFile.
+type InventoryGroup struct {
+	Hosts    []string          `json:"hosts,omitempty"`
+	Children []string          `json:"children,omitempty"`
+	Vars     map[string]string `json:"vars,omitempty"`
+}
+
+// InventoryFile holds groups, child groups, hosts and their vars,
+// declared in a single structured file.
+type InventoryFile struct {
+	Groups map[string]*InventoryGroup   `json:"groups"`
+	Hosts  map[string]map[string]string `json:"hosts,omitempty"`
+}
+
+// NewInventoryFile creates an empty InventoryFile.
+func NewInventoryFile() *InventoryFile {
+	return &InventoryFile{
+		Groups: make(map[string]*InventoryGroup),
+		Hosts:  make(map[string]map[string]string),
+	}
+}
+
+// FindInventoryFile looks for one of the default inventory files in
+// the current directory, and loads the first one found. Returns nil
+// if there is none.
+func FindInventoryFile() (*InventoryFile, error) {
+	for _, fname := range inventoryFileNames {
+		if _, err := os.Stat(fname); err == nil {
+			return LoadInventoryFile(fname)
+		}
+	}
+	return nil, nil
+}
+
+// LoadInventoryFile reads the named inventory file. The format is
+// picked by the file extension: ".ini" files are read as Ansible-style
+// INI, everything else as JSON.
+func LoadInventoryFile(fname string) (file *InventoryFile, err error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if path.Ext(fname) == ".ini" {
+		file, err = ReadInventoryINI(f)
+	} else {
+		file, err = ReadInventoryJSON(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	if err = file.check(); err != nil {
+		return nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	return file, nil
+}
+
+// ReadInventoryJSON parses an inventory in judo's own JSON layout.
+func ReadInventoryJSON(r io.Reader) (*InventoryFile, error) {
+	file := NewInventoryFile()
+	if err := json.NewDecoder(r).Decode(file); err != nil {
+		return nil, err
+	}
+	if file.Groups == nil {
+		file.Groups = make(map[string]*InventoryGroup)
+	}
+	for name, group := range file.Groups {
+		if group == nil {
+			file.Groups[name] = &InventoryGroup{}
+		}
+	}
+	if file.Hosts == nil {
+		file.Hosts = make(map[string]map[string]string)
+	}
+	return file, nil
+}
+
+// ReadInventoryINI parses an Ansible-style INI inventory: "[group]"
+// sections list hosts (optionally followed by key=value vars),
+// "[group:vars]" sections hold group vars, and "[group:children]"
+// sections list child groups. Hosts listed before any section end
+// up in the "ungrouped" group.
+func ReadInventoryINI(r io.Reader) (*InventoryFile, error) {
+	file := NewInventoryFile()
+	group, kind := "ungrouped", ""
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %d: bad section", lineno)
+			}
+			group, kind = line[1:len(line)-1], ""
+			if i := strings.LastIndex(group, ":"); i >= 0 {
+				group, kind = group[:i], group[i+1:]
+			}
+			switch kind {
+			case "", "vars", "children":
+			default:
+				return nil, fmt.Errorf(
+					"line %d: unknown section type: %s", lineno, kind)
+			}
+			file.group(group)
+			continue
+		}
+		fields, err := splitFields(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		switch kind {
+		case "":
+			name := fields[0]
+			g := file.group(group)
+			g.Hosts = append(g.Hosts, name)
+			vars, err := parseVars(fields[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineno, err)
+			}
+			file.addHostVars(name, vars)
+		case "vars":
+			vars, err := parseVars([]string{line})
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineno, err)
+			}
+			g := file.group(group)
+			if g.Vars == nil {
+				g.Vars = make(map[string]string)
+			}
+			for key, value := range vars {
+				g.Vars[key] = value
+			}
+		case "children":
+			g := file.group(group)
+			g.Children = append(g.Children, fields[0])
+			file.group(fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if g, ok := file.Groups["ungrouped"]; ok && len(g.Hosts) == 0 {
+		delete(file.Groups, "ungrouped")
+	}
+	return file, nil
+}
+
+// isAnsibleList reports whether the given group script output looks
+// like Ansible's dynamic inventory ("--list") JSON, rather than one
+// host per line.
+func isAnsibleList(lines []string) bool {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			return line[0] == '{'
+		}
+	}
+	return false
+}
+
+// ReadAnsibleList parses the output of an Ansible dynamic inventory
+// script, invoked with "--list". Each top-level key names a group,
+// holding either a list of hosts, or an object with "hosts",
+// "children" and "vars"; the special "_meta" key holds "hostvars".
+func ReadAnsibleList(r io.Reader) (*InventoryFile, error) {
+	var raw map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, err
+	}
+	file := NewInventoryFile()
+	for name, msg := range raw {
+		if name == "_meta" {
+			var meta struct {
+				Hostvars map[string]map[string]interface{} `json:"hostvars"`
+			}
+			if err := json.Unmarshal(msg, &meta); err != nil {
+				return nil, fmt.Errorf("_meta: %s", err)
+			}
+			for host, vars := range meta.Hostvars {
+				file.addHostVars(host, stringVars(vars))
+			}
+			continue
+		}
+		g := file.group(name)
+		var hosts []string
+		if err := json.Unmarshal(msg, &hosts); err == nil {
+			g.Hosts = hosts
+			continue
+		}
+		var group struct {
+			Hosts    []string               `json:"hosts"`
+			Children []string               `json:"children"`
+			Vars     map[string]interface{} `json:"vars"`
+		}
+		if err := json.Unmarshal(msg, &group); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		g.Hosts = group.Hosts
+		g.Children = group.Children
+		if len(group.Vars) > 0 {
+			g.Vars = stringVars(group.Vars)
+		}
+	}
+	for _, g := range file.Groups {
+		for _, child := range g.Children {
+			file.group(child)
+		}
+	}
+	if err := file.check(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// AllHosts lists every host mentioned in the inventory, in group
+// name order; hosts known only by their vars come last.
+func (file *InventoryFile) AllHosts() (names []string) {
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, group := range file.sortedGroups() {
+		for _, name := range file.Groups[group].Hosts {
+			add(name)
+		}
+	}
+	var rest []string
+	for name := range file.Hosts {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		add(name)
+	}
+	return
+}
+
+// stringVars converts arbitrary JSON values into strings; strings are
+// taken as they are, everything else is kept in its JSON form.
+func stringVars(vars map[string]interface{}) map[string]string {
+	out := make(map[string]string)
+	for key, value := range vars {
+		switch v := value.(type) {
+		case string:
+			out[key] = v
+		case nil:
+			out[key] = ""
+		default:
+			b, err := json.Marshal(v)
+			assert(err)
+			out[key] = string(b)
+		}
+	}
+	return out
+}
+
+// WriteJSON serializes the inventory in judo's own JSON layout.
+func (file *InventoryFile) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	return enc.Encode(file)
+}
+
+// HasGroup reports whether the named group is declared in the file.
+func (file *InventoryFile) HasGroup(name string) bool {
+	_, ok := file.Groups[name]
+	return ok
+}
+
+// HostVars returns the vars in effect for the named host. Vars of
+// the "all" group come first, then vars of the groups that contain
+// the host (parent groups before their children, otherwise in name
+// order), and finally the host's own vars.
+func (file *InventoryFile) HostVars(name string) map[string]string {
+	vars := make(map[string]string)
+	apply := func(group string) {
+		for key, value := range file.Groups[group].Vars {
+			vars[key] = value
+		}
+	}
+	if file.HasGroup("all") {
+		apply("all")
+	}
+	applied := map[string]bool{"all": true}
+	var applyWithParents func(group string)
+	applyWithParents = func(group string) {
+		if applied[group] {
+			return
+		}
+		applied[group] = true
+		for _, parent := range file.parents(group) {
+			applyWithParents(parent)
+		}
+		apply(group)
+	}
+	for _, group := range file.sortedGroups() {
+		if contains(file.Groups[group].Hosts, name) {
+			applyWithParents(group)
+		}
+	}
+	for key, value := range file.Hosts[name] {
+		vars[key] = value
+	}
+	return vars
+}
+
+func (file *InventoryFile) group(name string) *InventoryGroup {
+	g, ok := file.Groups[name]
+	if !ok {
+		g = &InventoryGroup{}
+		file.Groups[name] = g
+	}
+	return g
+}
+
+func (file *InventoryFile) addHostVars(name string, vars map[string]string) {
+	if len(vars) == 0 {
+		return
+	}
+	if file.Hosts[name] == nil {
+		file.Hosts[name] = make(map[string]string)
+	}
+	for key, value := range vars {
+		file.Hosts[name][key] = value
+	}
+}
+
+func (file *InventoryFile) sortedGroups() (names []string) {
+	for name := range file.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (file *InventoryFile) parents(name string) (parents []string) {
+	for _, group := range file.sortedGroups() {
+		if contains(file.Groups[group].Children, name) {
+			parents = append(parents, group)
+		}
+	}
+	return
+}
+
+// check verifies that all child groups exist, and that there are no
+// cycles between groups.
+func (file *InventoryFile) check() error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("group cycle through: %s", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, child := range file.Groups[name].Children {
+			if !file.HasGroup(child) {
+				return fmt.Errorf("%s: unknown child group: %s", name, child)
+			}
+			if err := visit(child); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, name := range file.sortedGroups() {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitFields splits an inventory line into whitespace-separated
+// fields, honoring single and double quotes, and dropping trailing
+// comments.
+func splitFields(line string) (fields []string, err error) {
+	var b strings.Builder
+	var quote rune
+	inField := false
+	for _, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				b.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inField = true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, b.String())
+				b.Reset()
+				inField = false
+			}
+		case c == '#' && !inField:
+			return fields, nil
+		default:
+			b.WriteRune(c)
+			inField = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, b.String())
+	}
+	return fields, nil
+}
+
+// parseVars turns a list of key=value fields into a map.
+func parseVars(fields []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, field := range fields {
+		elems := strings.SplitN(field, "=", 2)
+		if len(elems) != 2 {
+			return nil, fmt.Errorf("expected key=value: %s", field)
+		}
+		key := strings.TrimSpace(elems[0])
+		value, err := splitFields(elems[1])
+		if err != nil {
+			return nil, err
+		}
+		vars[key] = strings.Join(value, " ")
+	}
+	return vars, nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testInventoryINI = `# an Ansible inventory
+bastion ansible_host=10.0.0.1
+
+[web]
+web1 http_port=8080
+web2 motd="hello world" # comment
+
+[db]
+db1
+
+[prod:children]
+web
+db
+
+[prod:vars]
+ENV=production
+http_port=80
+`
+
+func TestReadInventoryINI(t *testing.T) {
+	file, err := ReadInventoryINI(strings.NewReader(testInventoryINI))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = file.check(); err != nil {
+		t.Error(err)
+	}
+	if !contains(file.Groups["ungrouped"].Hosts, "bastion") {
+		t.Error("bastion not ungrouped")
+	}
+	web := file.Groups["web"]
+	if len(web.Hosts) != 2 || web.Hosts[0] != "web1" || web.Hosts[1] != "web2" {
+		t.Error("web hosts:", web.Hosts)
+	}
+	prod := file.Groups["prod"]
+	if len(prod.Children) != 2 || prod.Vars["ENV"] != "production" {
+		t.Error("prod:", prod)
+	}
+	if file.Hosts["web2"]["motd"] != "hello world" {
+		t.Error("motd:", file.Hosts["web2"]["motd"])
+	}
+}
+
+func TestInventoryFileHostVars(t *testing.T) {
+	file, err := ReadInventoryINI(strings.NewReader(testInventoryINI))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	vars := file.HostVars("web1")
+	if vars["ENV"] != "production" {
+		t.Error("group var not inherited:", vars)
+	}
+	if vars["http_port"] != "8080" {
+		t.Error("host var not preferred:", vars)
+	}
+	vars = file.HostVars("web2")
+	if vars["http_port"] != "80" {
+		t.Error("group var:", vars)
+	}
+}
+
+func TestReadInventoryJSON(t *testing.T) {
+	file, err := ReadInventoryJSON(strings.NewReader(`{
+		"groups": {
+			"all": {"children": ["web"], "vars": {"A": "1"}},
+			"web": {"hosts": ["web1"], "vars": {"A": "2"}}
+		},
+		"hosts": {"web1": {"B": "3"}}
+	}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	vars := file.HostVars("web1")
+	if vars["A"] != "2" || vars["B"] != "3" {
+		t.Error("vars:", vars)
+	}
+}
+
+func TestInventoryFileCycle(t *testing.T) {
+	file, err := ReadInventoryINI(strings.NewReader(`
+[a:children]
+b
+[b:children]
+a
+`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if file.check() == nil {
+		t.Error("cycle not detected")
+	}
+}
+
+func TestInventoryPopulateFromFile(t *testing.T) {
+	file, err := ReadInventoryINI(strings.NewReader(testInventoryINI))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	inventory := NewInventory()
+	inventory.File = file
+	inventory.Populate([]string{"prod"})
+	var names []string
+	for host := range inventory.GetHosts() {
+		names = append(names, host.Name)
+		if host.Vars["ENV"] != "production" {
+			t.Error("no vars:", host.Name)
+		}
+	}
+	if strings.Join(names, " ") != "web1 web2 db1" {
+		t.Error("hosts:", names)
+	}
+}
+
+const testAnsibleList = `{
+	"web": {"hosts": ["web1"], "vars": {"port": 80}, "children": ["eu"]},
+	"eu": ["web2"],
+	"_meta": {"hostvars": {
+		"web1": {"ansible_host": "10.0.0.1", "AZ": "eu-west-1a"}
+	}}
+}`
+
+func TestIsAnsibleList(t *testing.T) {
+	if !isAnsibleList([]string{"", "  {", "}"}) {
+		t.Error("JSON not detected")
+	}
+	if isAnsibleList([]string{"web1", "web2"}) {
+		t.Error("lines detected as JSON")
+	}
+}
+
+func TestReadAnsibleList(t *testing.T) {
+	file, err := ReadAnsibleList(strings.NewReader(testAnsibleList))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Join(file.AllHosts(), " ") != "web2 web1" {
+		t.Error("hosts:", file.AllHosts())
+	}
+	vars := file.HostVars("web1")
+	if vars["port"] != "80" || vars["AZ"] != "eu-west-1a" {
+		t.Error("vars:", vars)
+	}
+	vars = file.HostVars("web2")
+	if vars["port"] != "80" {
+		t.Error("vars not inherited from parent:", vars)
+	}
+}
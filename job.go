@@ -5,14 +5,25 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"time"
 )
 
 // Script represents the file/directory to be sent to the remote Host
 // for execution, potentially as a part of a Job.
 type Script struct {
-	fname   string
-	dirmode bool
+	fname    string
+	dirmode  bool
+	hash     string
+	tree     []treeEntry
+	bundle   *Bundle
+	gzBundle *Bundle
+	stageDir string
+	staged   string
+	payload  []byte
+	m        *sync.Mutex
 }
 
 // Command represents an ad-hoc command to be executed on the remote
@@ -27,10 +38,45 @@ type Job struct {
 	*Inventory
 	*Script
 	*Command
-	Timeout time.Duration
-	AddEnv  map[string]string
-	SshArgs []string
-	signals chan os.Signal
+	Timeout     time.Duration
+	AddEnv      map[string]string
+	SshArgs     []string
+	Selection   *Selection
+	Gather      bool
+	Where       FactFilter
+	Snapshot    string
+	Transport   string
+	Push        string
+	Compress    bool
+	ScriptCache bool
+	Bootstrap   bool
+	Persist     time.Duration
+	ControlDir  string
+	Limiter     *RateLimiter
+	Ping        bool
+	Wait        string
+	FetchKeys   bool
+	RemoteDir   string
+	KeepWorkdir string
+	RunID       string
+	GC          bool
+	Prune       bool
+	OlderThan   time.Duration
+	WaitTimeout time.Duration
+	CacheKeep   int
+	// KnownHosts makes ssh(1) consult judo's known_hosts, before the
+	// files it would consult anyway.
+	KnownHosts bool
+	// ConnectTimeout, if set, bounds how long establishing a new SSH
+	// connection may take.
+	ConnectTimeout time.Duration
+	signals        chan os.Signal
+	// populated is closed once the inventory is populated, and the
+	// hosts can be cancelled.
+	populated chan struct{}
+	// record makes hosts record the output of the main command, as if
+	// the job took a snapshot (for tests).
+	record bool
 }
 
 // JobResult holds the per-host results of executing a Job.
@@ -41,7 +87,7 @@ func (result *JobResult) Report() (successful []string, failful map[string]error
 	failful = make(map[string]error)
 	for host := range *result {
 		err := (*result)[host]
-		if err == nil {
+		if !Failed(err) {
 			successful = append(successful, host.Name)
 		} else {
 			failful[host.Name] = err
@@ -50,6 +96,19 @@ func (result *JobResult) Report() (successful []string, failful map[string]error
 	return successful, failful
 }
 
+// ExitStatus returns judo's exit status for the result: 0 if all hosts
+// succeeded, 1 if some failed, 2 if all failed.
+func (result *JobResult) ExitStatus() int {
+	successful, failful := result.Report()
+	if len(failful) > 0 {
+		if len(successful) == 0 {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
 // NewCommand creates a Command.
 func NewCommand(cmd string) (command *Command) {
 	return &Command{cmd}
@@ -57,9 +116,12 @@ func NewCommand(cmd string) (command *Command) {
 
 // NewScript creates a script. The named file/directory must exist and
 // be either a regular, executable file, or a "dirmode" style
-// directory (with an executable file named "script" inside).
+// directory (with an executable file named "script" inside). The name
+// is cleaned up first, e.g. of a trailing slash, so that the script's
+// root is the same however it's sent.
 func NewScript(fname string) (script *Script, err error) {
-	script = &Script{fname: fname, dirmode: false}
+	fname = filepath.Clean(fname)
+	script = &Script{fname: fname, dirmode: false, m: &sync.Mutex{}}
 	stat, err := os.Stat(script.fname)
 	if err != nil {
 		return nil, err
@@ -80,6 +142,12 @@ func (script *Script) IsDirMode() bool {
 	return script.dirmode
 }
 
+// recordsOutput reports whether hosts should record the output of the
+// job's main command in their Output.
+func (job *Job) recordsOutput() bool {
+	return job.Snapshot != "" || job.record
+}
+
 // NewJob creates a new Job object.
 func NewJob(
 	inventory *Inventory, script *Script, command *Command,
@@ -88,36 +156,79 @@ func NewJob(
 	// https://golang.org/pkg/os/signal/#Notify
 	signals := make(chan os.Signal, 1)
 	return &Job{
-		Inventory: inventory,
-		Command:   command,
-		Script:    script,
-		Timeout:   timeout,
-		AddEnv:    env,
-		SshArgs:   sshArgs,
-		signals:   signals,
+		Inventory:   inventory,
+		Command:     command,
+		Script:      script,
+		Timeout:     timeout,
+		AddEnv:      env,
+		SshArgs:     sshArgs,
+		Push:        defaultPushMode,
+		CacheKeep:   defaultCacheKeep,
+		KeepWorkdir: keepNever,
+		RunID:       newRunID(),
+		OlderThan:   defaultOlderThan,
+		WaitTimeout: defaultWaitTimeout,
+		signals:     signals,
+		populated:   make(chan struct{}),
+	}
+}
+
+// MakeControlDir creates the job's private directory for the sockets
+// of SSH masters, so that concurrent runs don't step on each other's
+// masters.
+func (job *Job) MakeControlDir() (err error) {
+	job.ControlDir, err = os.MkdirTemp("", "judo.")
+	return
+}
+
+// Cleanup removes the job's private control directory, and the
+// private copy of the script, if any.
+func (job *Job) Cleanup() {
+	if job.ControlDir != "" {
+		os.RemoveAll(job.ControlDir)
+	}
+	if job.Script != nil {
+		job.Script.Cleanup()
 	}
 }
 
 // InstallSignalHandlers installs a signal handler, which will catch
-// interrupt requests, and cancel pending jobs.
-func (job Job) InstallSignalHandlers() {
-	signal.Notify(job.signals, os.Interrupt)
+// interrupt and termination requests, and cancel pending jobs. If
+// another request comes in before the hosts are done cleaning up, or
+// the request comes in while the inventory is still being populated,
+// judo removes its private files and exits right away.
+func (job *Job) InstallSignalHandlers() {
+	signal.Notify(job.signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		// wait for SIGINT
 		<-job.signals
+		select {
+		case <-job.populated:
+		default:
+			job.Cleanup()
+			os.Exit(130)
+		}
 		// let everyone know we're cancelling the operation
 		for host := range job.GetHosts() {
 			host.Cancel()
 		}
+		<-job.signals
+		job.Cleanup()
+		os.Exit(130)
 	}()
 }
 
-// PopulateInventory with given names; resolve additional arguments
-// and environment overrides.
-func (job Job) PopulateInventory(names []string) {
-	job.Inventory.Populate(names)
+// PopulateInventory with given names; resolve additional arguments,
+// environment overrides, and previously gathered facts.
+func (job Job) PopulateInventory(names []string) error {
+	if err := job.Inventory.Populate(names); err != nil {
+		return err
+	}
 	for host := range job.GetHosts() {
-		host.SshArgs = job.SshArgs
+		host.Facts, _ = LoadFacts(host.Name)
+		// hosts whose transport can't be set up fail when used
+		host.SetTransport(job.Transport)
+		host.SshArgs = append(sshArgsFromVars(host.Vars), job.SshArgs...)
 		for key, value := range job.AddEnv {
 			if _, has := host.Env[key]; has {
 				panic(fmt.Sprintf("Tried to override: %s", key))
@@ -125,12 +236,58 @@ func (job Job) PopulateInventory(names []string) {
 			host.Env[key] = value
 		}
 	}
+	select {
+	case <-job.populated:
+	default:
+		close(job.populated)
+	}
+	return nil
+}
+
+// SelectHosts narrows down the inventory to the hosts matching the
+// facts filter, and then to the selection of hosts. It returns the
+// hosts that were left out because they lack some of the facts, rather
+// than for having different ones.
+func (job Job) SelectHosts() (unknown []*Host) {
+	if job.Where != nil {
+		job.Inventory.Filter(func(host *Host) bool {
+			if job.Where.Match(host.Facts) {
+				return true
+			}
+			if len(job.Where.Missing(host.Facts)) > 0 {
+				unknown = append(unknown, host)
+			}
+			return false
+		})
+	}
+	if job.Selection != nil {
+		job.Inventory.Select(job.Selection)
+	}
+	return unknown
+}
+
+// GatherFacts runs the facts probe on all hosts.
+func (job *Job) GatherFacts() *JobResult {
+	return job.each(func(host *Host) error {
+		return host.GatherFacts(job)
+	})
 }
 
 // Execute is the entry point of a Job.
 func (job *Job) Execute() *JobResult {
 	// The heart of judo, run the Job on remote Hosts
+	return job.each(func(host *Host) error {
+		if job.Script != nil {
+			return host.SendRemoteAndRun(job)
+		} else if job.Command != nil {
+			return host.RunRemote(job)
+		}
+		panic("Should not happen")
+	})
+}
 
+// each runs f on every Host in parallel, and collects the results.
+func (job *Job) each(f func(host *Host) error) *JobResult {
 	// Deliver the results of the job's execution on each Host
 	var results = make(map[*Host]chan error)
 
@@ -139,13 +296,9 @@ func (job *Job) Execute() *JobResult {
 		ch := make(chan error)
 		results[host] = ch
 		go func(host *Host, ch chan error) {
-			var err error
-			if job.Script != nil {
-				err = host.SendRemoteAndRun(job)
-			} else if job.Command != nil {
-				err = host.RunRemote(job)
-			} else {
-				panic("Should not happen")
+			err := f(host)
+			if len(host.Warnings) > 0 {
+				err = &Warning{host.Warnings, err}
 			}
 			ch <- err
 			close(ch)
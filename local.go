@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+)
+
+// localTransport runs commands on the control machine itself, without
+// going through sshd(8).
+type localTransport struct {
+	host *Host
+}
+
+// Connect does nothing.
+func (t *localTransport) Connect(job *Job) error {
+	return nil
+}
+
+// Run runs the command line with the local shell.
+func (t *localTransport) Run(job *Job, cmdline string, stdin io.Reader) (*Proc, error) {
+	if stdin != nil {
+		return NewProcInput(stdin, "sh", "-c", cmdline)
+	}
+	return NewProc("sh", "-c", cmdline)
+}
+
+// Push copies files with cp(1).
+func (t *localTransport) Push(job *Job, local string, remote string) (*Proc, error) {
+	return NewProc("cp", "-R", local, remote)
+}
+
+// Close does nothing.
+func (t *localTransport) Close() error {
+	return nil
+}
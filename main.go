@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,12 +16,35 @@ const errUsage = `judo: use "judo -h" to get help"`
 const longHelp = `usage:
     judo [common flags] -s SCRIPT  [--] ssh-targets
     judo [common flags] -c COMMAND [--] ssh-targets
+    judo [common flags] --gather-facts [--] ssh-targets
+    judo [common flags] -p [--] ssh-targets
+    judo [common flags] --wait-up|--wait-down|--reboot
+                        [--wait-timeout DURATION] [--] ssh-targets
+    judo [common flags] --fetch-host-keys [--] ssh-targets
+    judo [common flags] --gc [--older-than AGE] [--] ssh-targets
+    judo --compare SNAPSHOT1 SNAPSHOT2
+    judo --import-ansible ANSIBLE_INVENTORY
+    judo --connections
+    judo [-i INVENTORY] --disconnect [--] [ssh-targets]
     judo -v [REQUIRED-VERSION]
     judo -h
-common flags:  [-t TIMEOUT] [-e KEY | KEY=VALUE] [-F SSH_CONFIG] [-d]
+common flags:  [-t TIMEOUT] [-e KEY | KEY=VALUE] [-F SSH_CONFIG]
+               [-J BASTION] [--host-keys POLICY]
+               [-i INVENTORY] [--transport ssh|local|exec]
+               [--push copy|tar] [--compress]
+               [--script-cache] [--cache-keep N] [--bootstrap]
+               [--persist DURATION] [--connect-rate N/s]
+               [--remote-dir DIR] [--keep-workdir on-failure|always]
+               [--prune] [--older-than AGE]
+               [--inventory-cache TTL]
+               [--refresh-inventory] [-d]
+target selection: [--first N | --limit N | --sample N|PERCENT%]
+               [--seed SEED] [--gather-facts] [--where KEY=VALUE,...]
 flags:
     -s  Execute specified SCRIPT (file) on remote targets
     -c  Execute specified shell COMMAND on remote targets
+    -p  Check that the targets are reachable, and have the
+        tools judo needs; nothing is sent or left behind
     -v  Display the software version; check that this binary
         is backward compatible with REQUIRED-VERSION
     -h  Display this help text
@@ -26,7 +52,97 @@ flags:
     -e  Set KEY to VALUE in the remote environment
         (default: take the value from the local environment)
     -F  Instruct ssh(1)/scp(1) to use custom SSH_CONFIG file
-    -d  More verbose debugging logs`
+    -J  Connect through the jump host BASTION (see ssh(1));
+        judo_ssh_proxy_jump in the inventory takes precedence
+    --host-keys
+        Check host keys: "strict" (only known keys), "accept-new"
+        (remember keys of new hosts), or "pinned[=FILE]" (only
+        the keys in FILE, default: judo's known_hosts)
+    --fetch-host-keys
+        Collect the targets' host keys, show their fingerprints,
+        and after approval, add them to judo's known_hosts
+    -i  Read groups, hosts and vars from INVENTORY (JSON or INI)
+        (default: inventory.json or inventory.ini, if present)
+    -d  More verbose debugging logs
+    --transport
+        Reach the targets with ssh(1) (the default), run locally
+        without sshd(8), or through the judo_exec and judo_copy
+        command templates; a judo_transport var in the inventory
+        takes precedence
+    --push
+        Send scripts with scp(1) or the transport's own copy
+        command (the default), or stream them as a tar archive,
+        preserving modes and symbolic links; the archive is
+        built once, and the same copy is sent to every target
+    --compress
+        Compress the tar archive with gzip (with --push tar)
+    --script-cache
+        Keep scripts in ~/.judo/cache on the targets, keyed by
+        their content, and only send them if they're missing
+    --cache-keep
+        Keep at most N scripts in the targets' cache (default: 5)
+    --bootstrap
+        Set up, send the script, run it, and clean up, all in a
+        single round trip to each target
+    --remote-dir
+        Create the targets' temporary working areas in DIR
+        (default: ~/.judo); a judo_remote_dir var in the
+        inventory takes precedence
+    --keep-workdir
+        Leave the working area on the target for inspection,
+        if the job fails, or always
+    --gc
+        Remove the working areas left on the targets by runs
+        that started more than AGE ago, and list them
+    --prune
+        Remove stale working areas (as with --gc) before running
+    --older-than
+        How old a working area must be to be removed, e.g. 12h
+        or 7d (default: 7d)
+    --persist
+        Keep the SSH connections open for DURATION (e.g. 10m)
+        after they were last used, to be reused by later runs
+    --connect-rate
+        Open at most N new SSH connections per second (N/s) or
+        per minute (N/m); targets waiting their turn are pending
+    --connections
+        List the SSH connections kept open with --persist
+    --disconnect
+        Close the SSH connections kept open to the targets,
+        or all of them if no targets are given
+    --inventory-cache
+        Cache the output of group scripts for TTL (e.g. 10m);
+        scripts can set their own with a "# judo: cache=TTL" line
+    --refresh-inventory
+        Run group scripts even if there is cached output
+    --first
+        Only run on the first N of the targets
+    --limit
+        Only run on N randomly picked targets
+    --sample
+        Only run on N, or PERCENT%, randomly picked targets
+    --seed
+        Seed the random choice of targets, to repeat a sample
+    --gather-facts
+        Probe the targets for facts (OS, architecture, CPUs,
+        memory, kernel), and remember them for later runs
+    --where
+        Only run on targets whose facts match all KEY=VALUE pairs
+    --snapshot
+        Save the output of the job on each target as SNAPSHOT
+    --compare
+        Report the targets whose output differs between the two
+        snapshots, and the differences
+    --import-ansible
+        Convert ANSIBLE_INVENTORY (INI) into judo's JSON inventory
+        layout, and print it
+    --wait-up, --wait-down
+        Wait until the targets can (or can't) be reached
+    --reboot
+        Reboot the targets, wait until they're back up, and
+        check that they have really rebooted
+    --wait-timeout
+        Give up waiting after DURATION (default: 5m)`
 
 const version = "0.6"
 
@@ -34,13 +150,74 @@ func parseArgs(args []string) (
 	job *Job, names []string, msg string,
 	status int, err error) {
 
-	names, opts, err := getopt.GetOpt(args, "s:c:vht:e:F:d", nil)
+	names, opts, err := getopt.GetOpt(
+		args, "s:c:pvht:e:F:J:i:d", []string{
+			"import-ansible=",
+			"inventory-cache=",
+			"refresh-inventory",
+			"first=",
+			"limit=",
+			"sample=",
+			"seed=",
+			"gather-facts",
+			"where=",
+			"snapshot=",
+			"compare=",
+			"transport=",
+			"push=",
+			"compress",
+			"script-cache",
+			"cache-keep=",
+			"bootstrap",
+			"persist=",
+			"connect-rate=",
+			"host-keys=",
+			"remote-dir=",
+			"keep-workdir=",
+			"gc",
+			"prune",
+			"older-than=",
+			"fetch-host-keys",
+			"wait-up",
+			"wait-down",
+			"reboot",
+			"wait-timeout=",
+			"connections",
+			"disconnect",
+		})
 	if err != nil {
 		return nil, nil, errUsage, 111, err
 	}
 
 	var script *Script
 	var command *Command
+	var file *InventoryFile
+	var cache = NewScriptCache()
+	var sshConfig = defaultSSHConfig()
+	var selection *Selection
+	var seed = time.Now().UnixNano()
+	var gather bool
+	var ping bool
+	var wait string
+	var hostKeys string
+	var remoteDir string
+	var keepWorkdir = keepNever
+	var fetchKeys bool
+	var gc bool
+	var prune bool
+	var olderThan = defaultOlderThan
+	var waitTimeout = defaultWaitTimeout
+	var where FactFilter
+	var snapshot string
+	var transport string
+	var push = defaultPushMode
+	var compress bool
+	var scriptCache bool
+	var bootstrap bool
+	var persist time.Duration
+	var limiter *RateLimiter
+	var disconnect bool
+	var cacheKeep = defaultCacheKeep
 	var timeout = time.Duration(30) * time.Second
 	sshArgs := []string{}
 	env := make(map[string]string)
@@ -54,6 +231,46 @@ func parseArgs(args []string) (
 			}
 		case "-c":
 			command = NewCommand(opt.Arg())
+		case "-p":
+			ping = true
+		case "--remote-dir":
+			remoteDir = opt.Arg()
+		case "--keep-workdir":
+			keepWorkdir = opt.Arg()
+			if keepWorkdir != keepOnFailure && keepWorkdir != keepAlways {
+				return nil, nil, errUsage, 111, argumentError{
+					Message: "--keep-workdir " + keepWorkdir,
+				}
+			}
+		case "--gc":
+			gc = true
+		case "--prune":
+			prune = true
+		case "--older-than":
+			olderThan, err = ParseAge(opt.Arg())
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--host-keys":
+			hostKeys = opt.Arg()
+		case "--fetch-host-keys":
+			fetchKeys = true
+		case "--wait-up", "--wait-down", "--reboot":
+			if wait != "" {
+				return nil, nil, errUsage, 111, argumentError{
+					Message: "only one of --wait-up, --wait-down, --reboot",
+				}
+			}
+			wait = map[string]string{
+				"--wait-up":   waitUp,
+				"--wait-down": waitDown,
+				"--reboot":    waitReboot,
+			}[opt.Opt()]
+		case "--wait-timeout":
+			waitTimeout, err = time.ParseDuration(opt.Arg())
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
 		case "-v":
 			if len(names) > 0 && version != names[0] {
 				return nil, nil, version, 1, nil
@@ -71,33 +288,281 @@ func parseArgs(args []string) (
 			if err != nil {
 				return nil, nil, errUsage, 111, err
 			}
+		case "-J":
+			sshArgs = append(sshArgs, "-o", "ProxyJump="+opt.Arg())
 		case "-F":
 			sshArgs = append(sshArgs, "-F", opt.Arg())
+			sshConfig = opt.Arg()
+		case "-i":
+			file, err = LoadInventoryFile(opt.Arg())
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
 		case "-d":
 			moreDebugLogging()
+		case "--inventory-cache":
+			cache.TTL, err = time.ParseDuration(opt.Arg())
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--refresh-inventory":
+			cache.Refresh = true
+		case "--first", "--limit", "--sample":
+			if selection != nil {
+				return nil, nil, errUsage, 111, argumentError{
+					Message: "only one of --first, --limit, --sample",
+				}
+			}
+			selection = &Selection{Random: opt.Opt() != "--first"}
+			if opt.Opt() == "--sample" {
+				selection.Count, selection.Percent, err = ParseSample(opt.Arg())
+			} else {
+				selection.Count, err = strconv.Atoi(opt.Arg())
+				if err == nil && selection.Count < 1 {
+					err = argumentError{Message: opt.Opt() + " " + opt.Arg()}
+				}
+			}
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--seed":
+			seed, err = strconv.ParseInt(opt.Arg(), 10, 64)
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--gather-facts":
+			gather = true
+		case "--where":
+			where, err = ParseFactFilter(opt.Arg())
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--snapshot":
+			snapshot = opt.Arg()
+			if err = CheckSnapshotName(snapshot); err != nil {
+				return nil, nil, errUsage, 111, argumentError{
+					Message: err.Error(),
+				}
+			}
+		case "--compare":
+			if len(names) != 1 {
+				return nil, nil, errUsage, 111, nil
+			}
+			report, changed, err := CompareSnapshots(opt.Arg(), names[0])
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+			if changed {
+				return nil, nil, report, 1, nil
+			}
+			return nil, nil, report, 0, nil
+		case "--transport":
+			transport = opt.Arg()
+			if err = CheckTransport(transport); err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--push":
+			push = opt.Arg()
+			if push != pushCopy && push != pushTar {
+				return nil, nil, errUsage, 111, argumentError{
+					Message: "unknown push mode: " + push,
+				}
+			}
+		case "--compress":
+			compress = true
+		case "--script-cache":
+			scriptCache = true
+		case "--cache-keep":
+			cacheKeep, err = strconv.Atoi(opt.Arg())
+			if err == nil && cacheKeep < 1 {
+				err = argumentError{Message: "--cache-keep " + opt.Arg()}
+			}
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--bootstrap":
+			bootstrap = true
+		case "--persist":
+			persist, err = time.ParseDuration(opt.Arg())
+			if err == nil && persist < time.Second {
+				err = argumentError{Message: "--persist " + opt.Arg()}
+			}
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--connect-rate":
+			limiter, err = ParseRate(opt.Arg())
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+		case "--connections":
+			msg, err = ListConnections()
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+			return nil, nil, msg, 0, nil
+		case "--disconnect":
+			disconnect = true
+		case "--import-ansible":
+			msg, err = importAnsible(opt.Arg())
+			if err != nil {
+				return nil, nil, errUsage, 111, err
+			}
+			return nil, nil, msg, 0, nil
 		default:
 			panic("unexpected argument")
 		}
 	}
 
-	if script == nil && command == nil {
+	if disconnect {
+		msg, err = disconnectTargets(names, file, sshConfig)
+		if err != nil {
+			return nil, nil, errUsage, 111, err
+		}
+		return nil, nil, msg, 0, nil
+	}
+
+	if snapshot != "" && script == nil && command == nil {
+		return nil, nil, errUsage, 111, nil
+	}
+
+	modes := 0
+	for _, mode := range []bool{
+		script != nil || command != nil, ping, wait != "", fetchKeys, gc,
+	} {
+		if mode {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return nil, nil, errUsage, 111, nil
+	}
+
+	if modes == 0 && !gather {
 		return nil, nil, errUsage, 111, nil
 	}
 
+	if bootstrap && (push != pushCopy || scriptCache ||
+		keepWorkdir != keepNever || prune) {
+		return nil, nil, errUsage, 111, argumentError{
+			Message: "--bootstrap can't be combined with " +
+				"--push, --script-cache, --keep-workdir or --prune",
+		}
+	}
+
+	if compress && push != pushTar {
+		return nil, nil, errUsage, 111, argumentError{
+			Message: "--compress requires --push tar",
+		}
+	}
+
 	for _, name := range names {
-		if strings.Contains(name, "@") {
-			errMsg := fmt.Sprintf("error: malformed hostname: %s", name)
+		if strings.HasPrefix(name, sshConfigPrefix) {
+			continue
+		}
+		if _, err := ParseTarget(name); err != nil {
+			errMsg := fmt.Sprintf("error: %s", err)
 			return nil, nil, errMsg, 1, nil
 		}
 	}
 
+	if file == nil {
+		file, err = FindInventoryFile()
+		if err != nil {
+			return nil, nil, errUsage, 111, err
+		}
+	}
+
 	inventory := NewInventory()
 	inventory.Timeout = timeout
+	inventory.File = file
+	inventory.Cache = cache
+	inventory.SSHConfig = sshConfig
+	keyArgs, knownHosts, err := hostKeyArgs(hostKeys)
+	if err != nil {
+		return nil, nil, errUsage, 111, err
+	}
+	sshArgs = append(sshArgs, keyArgs...)
 	job = NewJob(inventory, script, command, env, sshArgs, timeout)
+	job.KnownHosts = knownHosts
+	if selection != nil {
+		selection.Seed = seed
+		job.Selection = selection
+	}
+	job.Gather = gather
+	job.Where = where
+	job.Snapshot = snapshot
+	job.Transport = transport
+	job.Push = push
+	job.Compress = compress
+	job.ScriptCache = scriptCache
+	job.CacheKeep = cacheKeep
+	job.Bootstrap = bootstrap
+	job.Persist = persist
+	job.Limiter = limiter
+	job.Ping = ping
+	job.Wait = wait
+	job.WaitTimeout = waitTimeout
+	job.FetchKeys = fetchKeys
+	job.RemoteDir = remoteDir
+	job.KeepWorkdir = keepWorkdir
+	job.GC = gc
+	job.Prune = prune
+	job.OlderThan = olderThan
 
 	return job, names, "", 0, nil
 }
 
+// importAnsible converts the named Ansible INI inventory into judo's
+// JSON inventory layout.
+func importAnsible(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	file, err := ReadInventoryINI(f)
+	if err == nil {
+		err = file.check()
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", fname, err)
+	}
+	var b strings.Builder
+	if err = file.WriteJSON(&b); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// disconnectTargets closes the persistent connections to the named
+// targets, which may be groups; or to all hosts, if none are named.
+func disconnectTargets(names []string, file *InventoryFile, sshConfig string) (string, error) {
+	if len(names) == 0 {
+		return Disconnect(nil)
+	}
+	var err error
+	if file == nil {
+		if file, err = FindInventoryFile(); err != nil {
+			return "", err
+		}
+	}
+	inventory := NewInventory()
+	inventory.File = file
+	inventory.SSHConfig = sshConfig
+	if err = inventory.Populate(names); err != nil {
+		return "", err
+	}
+	var hosts []string
+	for host := range inventory.GetHosts() {
+		hosts = append(hosts, host.Name)
+	}
+	if len(hosts) == 0 {
+		return "No connections", nil
+	}
+	return Disconnect(hosts)
+}
+
 type argumentError struct {
 	Message string
 }
@@ -131,45 +596,144 @@ func parseEnvArg(arg string, env map[string]string) error {
 }
 
 func main() {
-	job, names, msg, status, err := parseArgs(os.Args[1:])
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs judo with the given arguments, and returns its exit status.
+// The job's private files are removed however it ends: by returning,
+// by a panic, or by a second interrupt.
+func run(args []string) int {
+	job, names, msg, status, err := parseArgs(args)
 	if err != nil {
 		fmt.Println(err)
 		status = 111
 	}
 	if msg != "" {
 		fmt.Println(msg)
-		os.Exit(status)
+		return status
 	}
 	if status != 0 {
-		os.Exit(status)
+		return status
+	}
+	if err = job.MakeControlDir(); err != nil {
+		fmt.Println(err)
+		return 111
 	}
-	job.PopulateInventory(names)
+	defer job.Cleanup()
 	job.InstallSignalHandlers()
+	if err = job.PopulateInventory(names); err != nil {
+		fmt.Printf("error: %s\n", err)
+		return 1
+	}
+
+	var result JobResult = make(map[*Host]error)
+	if job.Gather {
+		for host, err := range *job.GatherFacts() {
+			if Failed(err) {
+				result[host] = err
+			}
+		}
+		job.Inventory.Filter(func(host *Host) bool {
+			_, failed := result[host]
+			return !failed
+		})
+	}
+	for _, host := range job.SelectHosts() {
+		fmt.Printf("Skipped: %s: no facts: %s\n", host.Name,
+			strings.Join(job.Where.Missing(host.Facts), ", "))
+	}
+
+	if job.Ping {
+		pingResult, table := job.PingHosts()
+		fmt.Print(table)
+		return pingResult.ExitStatus()
+	}
 
-	fmt.Printf("Running: %v\n", func() (names []string) {
-		// look mama, Go has list comprehensions
+	if job.FetchKeys {
+		fetched, err := job.FetchHostKeys(os.Stdin, os.Stdout)
+		if err != nil {
+			fmt.Println(err)
+			return 111
+		}
+		for host, err := range *fetched {
+			result[host] = err
+		}
+	} else if job.GC {
+		for host, err := range *job.GCHosts() {
+			result[host] = err
+		}
+	} else if job.Wait != "" {
+		for host, err := range *job.WaitHosts() {
+			result[host] = err
+		}
+	} else if job.Script == nil && job.Command == nil {
 		for host := range job.GetHosts() {
-			names = append(names, host.Name)
+			result[host] = nil
+		}
+	} else {
+		fmt.Printf("Running: %v", func() (names []string) {
+			// look mama, Go has list comprehensions
+			for host := range job.GetHosts() {
+				names = append(names, host.Name)
+			}
+			return
+		}())
+		if job.Selection != nil {
+			fmt.Printf(" (%s)", job.Selection)
+		}
+		fmt.Println()
+		executed := job.Execute()
+		if job.Snapshot != "" {
+			if err = ClearSnapshot(job.Snapshot); err != nil {
+				fmt.Printf("Snapshot failed: %s\n", err)
+			}
+		}
+		for host, err := range *executed {
+			result[host] = err
+			if job.Snapshot != "" && !Failed(err) {
+				if err = SaveSnapshot(job.Snapshot, job, host); err != nil {
+					fmt.Printf("Snapshot failed: %s: %s\n", host.Name, err)
+				}
+			}
+		}
+	}
+	var warnings []string
+	for host, err := range result {
+		for _, warning := range Warnings(err) {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", host.Name, warning))
+		}
+	}
+	sort.Strings(warnings)
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	var kept []string
+	for host := range result {
+		if host.KeptWorkdir != "" {
+			kept = append(kept, fmt.Sprintf("%s: %s", host.Name, host.KeptWorkdir))
 		}
-		return
-	}())
-	result := job.Execute()
+	}
+	sort.Strings(kept)
+	for _, line := range kept {
+		fmt.Printf("Kept: %s\n", line)
+	}
 	successful, failful := result.Report()
+	var pending []string
 	if len(failful) > 0 {
 		for host := range failful {
+			if errors.Is(failful[host], ErrorPending) {
+				pending = append(pending, host)
+				continue
+			}
 			fmt.Printf("Failed: %s: %s\n", host, failful[host])
 		}
 	}
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		fmt.Printf("Pending: %v\n", pending)
+	}
 	if len(successful) > 0 {
 		fmt.Printf("Success: %v\n", successful)
 	}
-
-	if len(failful) > 0 {
-		if len(successful) == 0 {
-			os.Exit(2)
-		} else {
-			os.Exit(1)
-		}
-	}
-	os.Exit(0)
+	return result.ExitStatus()
 }
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMainParseHelp(t *testing.T) {
@@ -123,18 +125,27 @@ func TestMainParseNames(t *testing.T) {
 }
 
 func TestMainParseBadNames(t *testing.T) {
-	_, gotNames, msg, status, _ := parseArgs([]string{"-c", "true", "user@foo", "bar"})
+	_, gotNames, msg, status, _ := parseArgs([]string{"-c", "true", "foo:bar", "bar"})
 	if status == 0 {
 		t.Error("status")
 	}
 	if len(gotNames) != 0 {
 		t.Error("len(gotNames)")
 	}
-	if !strings.HasPrefix(msg, "error:") || !strings.HasSuffix(msg, "user@foo") {
+	if !strings.HasPrefix(msg, "error:") || !strings.HasSuffix(msg, "foo:bar") {
 		t.Error("msg")
 	}
 }
 
+func TestMainParseTargets(t *testing.T) {
+	_, gotNames, msg, status, err := parseArgs([]string{
+		"-c", "true", "user@foo", "foo:2222", "[2001:db8::1]:22",
+	})
+	if err != nil || status != 0 || msg != "" || len(gotNames) != 3 {
+		t.Error("targets rejected:", msg)
+	}
+}
+
 func TestMainParseExtraConfig(t *testing.T) {
 	job, _, _, _, err := parseArgs([]string{"-F", "./ssh_config", "-c", "true"})
 	if err != nil {
@@ -154,3 +165,92 @@ func TestMainParseExtraConfig(t *testing.T) {
 		t.Error("job.SshArgs")
 	}
 }
+
+func TestMainParseInventory(t *testing.T) {
+	job, _, _, _, err := parseArgs([]string{"-i", "inventory.json", "-c", "true"})
+	if err == nil {
+		t.Error("expected error for missing inventory")
+	}
+	if job != nil {
+		t.Error("job not nil")
+	}
+}
+
+func TestMainParseSSHConfigNames(t *testing.T) {
+	job, names, _, status, err := parseArgs(
+		[]string{"-F", "./ssh_config", "-c", "true", "@sshconfig:web"})
+	if err != nil || status != 0 || len(names) != 1 {
+		t.Error("names:", names, status, err)
+		return
+	}
+	if job.Inventory.SSHConfig != "./ssh_config" {
+		t.Error("SSHConfig:", job.Inventory.SSHConfig)
+	}
+}
+
+func TestMainParseSelection(t *testing.T) {
+	job, _, _, _, err := parseArgs([]string{"--sample", "5%", "--seed", "7", "-c", "true"})
+	if err != nil || job.Selection == nil {
+		t.Error("no selection", err)
+		return
+	}
+	if !job.Selection.Random || job.Selection.Percent != 5 || job.Selection.Seed != 7 {
+		t.Error("selection:", job.Selection)
+	}
+	_, _, _, status, _ := parseArgs([]string{"--first", "1", "--limit", "2", "-c", "true"})
+	if status == 0 {
+		t.Error("conflicting selections accepted")
+	}
+}
+
+func TestMainParsePersist(t *testing.T) {
+	job, _, _, _, err := parseArgs([]string{"--persist", "10m", "-c", "true"})
+	if err != nil || job.Persist != 10*time.Minute {
+		t.Error("persist not set:", err)
+	}
+	_, _, _, status, _ := parseArgs([]string{"--persist", "0s", "-c", "true"})
+	if status != 111 {
+		t.Error("zero persist accepted")
+	}
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	_, _, msg, status, err := parseArgs([]string{"--connections"})
+	if err != nil || status != 0 || msg != "No connections" {
+		t.Error("connections:", msg, status, err)
+	}
+	_, _, msg, status, err = parseArgs([]string{"--disconnect"})
+	if err != nil || status != 0 || msg != "No connections" {
+		t.Error("disconnect:", msg, status, err)
+	}
+}
+
+func TestMainParseGC(t *testing.T) {
+	job, _, _, _, err := parseArgs([]string{"--gc", "--older-than", "2d"})
+	if err != nil || !job.GC || job.OlderThan != 48*time.Hour {
+		t.Error("gc not set:", err)
+	}
+	_, _, _, status, _ := parseArgs([]string{"--gc", "-c", "true"})
+	if status != 111 {
+		t.Error("--gc accepted with -c")
+	}
+	_, _, _, status, _ = parseArgs([]string{"--prune", "--bootstrap", "-s", "examples/hello.sh"})
+	if status != 111 {
+		t.Error("--prune accepted with --bootstrap")
+	}
+}
+
+func TestMainRunCleanup(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	t.Setenv("HOME", t.TempDir())
+	for _, args := range [][]string{
+		{"--transport", "local", "-s", "examples/hello.sh", "localhost"},
+		{"--transport", "local", "-c", "exit 3", "localhost"},
+	} {
+		run(args)
+		entries, err := os.ReadDir(tmp)
+		assert(err)
+		if len(entries) != 0 {
+			t.Error(args, "left behind:", entries[0].Name())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// pingProbe checks, without leaving anything behind, that the host
+// has what SendRemoteAndRun needs, and that it can create a workdir
+// the same way (2), in its remote directory (1) or elsewhere. Each
+// problem is reported on a line of its own; "warning: " lines are
+// problems that won't stop a job.
+const pingProbe = `
+for t in env mkdir mktemp rm; do
+	command -v "$t" > /dev/null 2>&1 || echo "missing $t"
+done
+fresh=
+[ -d %[1]s ] || fresh=1
+finish() {
+	[ -z "$fresh" ] || rmdir %[1]s 2> /dev/null
+	exit 0
+}
+%[2]s
+case "$w" in "$b"/*) ;; *) echo "broken mktemp TMPDIR" ;; esac
+mkdir -p "$w/a/b" 2> /dev/null || echo "broken mkdir -p"
+rm -r "$w" 2> /dev/null || echo "broken rm -r"
+finish
+`
+
+// PingResult says whether a host is ready to run jobs.
+type PingResult struct {
+	Latency  time.Duration
+	Problems []string
+	Warnings []string
+	Err      error
+}
+
+// Status sums up the result: "ready", "unreachable", or "not ready".
+func (r *PingResult) Status() string {
+	switch {
+	case r.Err != nil:
+		return "unreachable"
+	case len(r.Problems) > 0:
+		return "not ready"
+	}
+	return "ready"
+}
+
+// Details sums up the problems and warnings, for the user.
+func (r *PingResult) Details() string {
+	if err := r.Error(); err != nil {
+		return err.Error()
+	}
+	return strings.Join(r.Warnings, ", ")
+}
+
+// Error returns the reason why the host isn't ready, if it isn't.
+func (r *PingResult) Error() error {
+	if r.Err != nil {
+		return r.Err
+	}
+	if len(r.Problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(r.Problems, ", "))
+	}
+	return nil
+}
+
+// Ping connects to the host, measures the round trip time of a
+// trivial command, and runs the prerequisite checks.
+func (host *Host) Ping(job *Job) *PingResult {
+	result := &PingResult{}
+	if result.Err = host.transport.Connect(job); result.Err != nil {
+		return result
+	}
+	defer host.transport.Close()
+	start := time.Now()
+	if _, result.Err = host.readLines(job, "true"); result.Err != nil {
+		return result
+	}
+	result.Latency = time.Since(start)
+	// run the probe without env(1), which is one of the things it
+	// checks for
+	lines, err := host.readLines(job, fmt.Sprintf(pingProbe,
+		host.remoteDir(job), host.selectWorkdir(job, "finish")))
+	for _, line := range lines {
+		if warning := strings.TrimPrefix(line, "warning: "); warning != line {
+			result.Warnings = append(result.Warnings, warning)
+		} else {
+			result.Problems = append(result.Problems, line)
+		}
+	}
+	result.Err = err
+	return result
+}
+
+// PingHosts pings all hosts, and returns the results, along with a
+// table for the user.
+func (job *Job) PingHosts() (*JobResult, string) {
+	var m sync.Mutex
+	pings := make(map[*Host]*PingResult)
+	result := job.each(func(host *Host) error {
+		ping := host.Ping(job)
+		m.Lock()
+		pings[host] = ping
+		m.Unlock()
+		return ping.Error()
+	})
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tLATENCY\tDETAILS")
+	for host := range job.GetHosts() {
+		ping := pings[host]
+		latency := "-"
+		if ping.Err == nil {
+			latency = ping.Latency.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			host.Name, ping.Status(), latency, ping.Details())
+	}
+	w.Flush()
+	return result, b.String()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostPingLocal(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	ping := host.Ping(newTestJob(nil, nil))
+	if ping.Status() != "ready" || ping.Error() != nil {
+		t.Error("ping:", ping.Status(), ping.Error())
+	}
+	entries, err := os.ReadDir(os.Getenv("HOME"))
+	assert(err)
+	if len(entries) != 0 {
+		t.Error("left behind:", entries[0].Name())
+	}
+}
+
+func TestHostPingMissingTools(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	bin := t.TempDir()
+	for _, name := range []string{"sh", "env", "mkdir", "rm"} {
+		fname, err := exec.LookPath(name)
+		assert(err)
+		assert(os.Symlink(fname, path.Join(bin, name)))
+	}
+	t.Setenv("PATH", bin)
+	ping := host.Ping(newTestJob(nil, nil))
+	if ping.Status() != "not ready" ||
+		!strings.HasPrefix(ping.Error().Error(), "missing mktemp") {
+		t.Error("ping:", ping.Status(), ping.Error())
+	}
+}
+
+func TestHostPingUnreachable(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	host.Vars["judo_exec"] = "false {host}"
+	host.Vars["judo_copy"] = "false {src} {dst}"
+	assert(host.SetTransport("exec"))
+	ping := host.Ping(newTestJob(nil, nil))
+	if ping.Status() != "unreachable" {
+		t.Error("ping:", ping.Status(), ping.Error())
+	}
+}
+
+func TestJobPingHosts(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	inventory := NewInventory()
+	inventory.Populate([]string{"localhost", "elsewhere"})
+	job := NewJob(inventory, nil, nil, map[string]string{}, []string{},
+		10*time.Second)
+	for host := range job.GetHosts() {
+		host.logger.SetOutput(&strings.Builder{})
+		if host.Name == "elsewhere" {
+			host.Vars["judo_exec"] = "false {host}"
+			host.Vars["judo_copy"] = "false {src} {dst}"
+			assert(host.SetTransport("exec"))
+		} else {
+			assert(host.SetTransport("local"))
+		}
+	}
+	result, table := job.PingHosts()
+	if result.ExitStatus() != 1 {
+		t.Error("exit status:", result.ExitStatus())
+	}
+	lines := strings.Split(strings.TrimSpace(table), "\n")
+	if len(lines) != 3 ||
+		!strings.HasPrefix(lines[1], "localhost  ready") ||
+		!strings.HasPrefix(lines[2], "elsewhere  unreachable  -") {
+		t.Error("table:\n" + table)
+	}
+}
+
+func TestHostPingRemoteDir(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	t.Setenv("TMPDIR", t.TempDir())
+	host.Vars["judo_remote_dir"] = "/proc/judo"
+	ping := host.Ping(newTestJob(nil, nil))
+	if ping.Status() != "ready" ||
+		ping.Details() != "can't create workdir in /proc/judo" {
+		t.Error("ping:", ping.Status(), ping.Details())
+	}
+
+	host.Vars["judo_remote_dir"] = "~/work"
+	ping = host.Ping(newTestJob(nil, nil))
+	if ping.Status() != "ready" || ping.Details() != "" {
+		t.Error("ping:", ping.Status(), ping.Details())
+	}
+	if _, err := os.Stat(path.Join(os.Getenv("HOME"), "work")); !os.IsNotExist(err) {
+		t.Error("remote directory left behind")
+	}
+}
@@ -14,6 +14,7 @@ type Proc struct {
 	stdout chan string
 	stderr chan string
 	done   chan error
+	exited chan struct{}
 
 	cmd *exec.Cmd
 }
@@ -77,32 +78,56 @@ func writeLines(w io.WriteCloser, ch <-chan string, done chan<- interface{}) {
 
 // NewProc allocates and starts a new Proc.
 func NewProc(name string, args ...string) (proc *Proc, err error) {
+	return newProc(nil, name, args...)
+}
+
+// NewProcInput allocates and starts a new Proc, which reads its
+// standard input from r, rather than from the Stdin channel.
+func NewProcInput(r io.Reader, name string, args ...string) (proc *Proc, err error) {
+	return newProc(r, name, args...)
+}
+
+func newProc(r io.Reader, name string, args ...string) (proc *Proc, err error) {
 	bufsz := 0
 	proc = &Proc{
 		stdin:  make(chan string, bufsz),
 		stdout: make(chan string, bufsz),
 		stderr: make(chan string, bufsz),
 		done:   make(chan error),
+		exited: make(chan struct{}),
 		cmd:    exec.Command(name, args...),
 	}
 	done := make(chan interface{})
-	pw0, err := proc.cmd.StdinPipe()
-	assert(err)
+	var pw0 io.WriteCloser
+	if r == nil {
+		pw0, err = proc.cmd.StdinPipe()
+		assert(err)
+	} else {
+		proc.cmd.Stdin = r
+	}
 	pr1, err := proc.cmd.StdoutPipe()
 	assert(err)
 	pr2, err := proc.cmd.StderrPipe()
 	assert(err)
+	if err = proc.cmd.Start(); err != nil {
+		return nil, err
+	}
 	go func() {
-		assert(proc.cmd.Start())
 		<-done
 		<-done
 		<-done
-		err = proc.cmd.Wait()
+		err := proc.cmd.Wait()
+		close(proc.exited)
 		proc.done <- err
 		close(proc.done)
-		proc.cmd = nil
 	}()
-	go writeLines(pw0, proc.stdin, done)
+	if r == nil {
+		go writeLines(pw0, proc.stdin, done)
+	} else {
+		go func() {
+			done <- nil
+		}()
+	}
 	go scanLines(pr1, proc.stdout, done)
 	go scanLines(pr2, proc.stderr, done)
 	return
@@ -110,7 +135,12 @@ func NewProc(name string, args ...string) (proc *Proc, err error) {
 
 // IsAlive reports whether the process is still running.
 func (proc Proc) IsAlive() bool {
-	return proc.cmd != nil
+	select {
+	case <-proc.exited:
+		return false
+	default:
+		return true
+	}
 }
 
 // Signal sends the given signal to proc.
@@ -120,3 +150,23 @@ func (proc Proc) Signal(sig os.Signal) error {
 	}
 	return proc.cmd.Process.Signal(sig)
 }
+
+// Kill kills the process, if it's still running, and discards
+// whatever it has yet to say, so that nothing is left waiting on it.
+func (proc *Proc) Kill() {
+	if proc.IsAlive() {
+		// it may exit on its own in the meantime, which is just as well
+		proc.cmd.Process.Kill()
+	}
+	go func() {
+		for range proc.stdout {
+		}
+	}()
+	go func() {
+		for range proc.stderr {
+		}
+	}()
+	go func() {
+		<-proc.done
+	}()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -79,3 +80,33 @@ func TestManyHellos(t *testing.T) {
 		}
 	}
 }
+
+func TestProcInput(t *testing.T) {
+	proc, err := NewProcInput(strings.NewReader("hello\x00world\n"), "od", "-c")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	close(proc.Stdin())
+	var out []string
+	for {
+		select {
+		case line, ok := <-proc.Stdout():
+			if ok {
+				out = append(out, line)
+			}
+		case <-proc.Stderr():
+		case err := <-proc.Done():
+			if err != nil {
+				t.Error(err)
+			}
+			if len(out) == 0 || !strings.Contains(out[0], `\0`) {
+				t.Error("unexpected output:", out)
+			}
+			return
+		case <-time.After(1 * time.Second):
+			t.Error("timeout")
+			return
+		}
+	}
+}
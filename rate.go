@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter hands out tokens at a steady rate, one at a time: a
+// token bucket that holds a single token.
+type RateLimiter struct {
+	interval time.Duration
+	next     time.Time
+	m        *sync.Mutex
+}
+
+// ParseRate parses a rate like "5/s" or "30/m" (per second if the
+// unit is left out) into a RateLimiter.
+func ParseRate(s string) (*RateLimiter, error) {
+	count, unit := s, "s"
+	if i := strings.Index(s, "/"); i >= 0 {
+		count, unit = s[:i], s[i+1:]
+	}
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("bad rate: %s", s)
+	}
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	default:
+		return nil, fmt.Errorf("bad rate: %s", s)
+	}
+	return NewRateLimiter(time.Duration(float64(per) / n)), nil
+}
+
+// NewRateLimiter creates a RateLimiter, which hands out a token every
+// interval.
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	return &RateLimiter{interval: interval, m: &sync.Mutex{}}
+}
+
+// Wait waits for a token. If cancel fires first, it returns
+// ErrorPending.
+func (limiter *RateLimiter) Wait(cancel <-chan bool) error {
+	limiter.m.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	at := limiter.next
+	limiter.next = limiter.next.Add(limiter.interval)
+	limiter.m.Unlock()
+
+	delay := time.Until(at)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-cancel:
+		return ErrorPending
+	}
+}
+
+// waitToConnect waits until the job's rate limit allows the host to
+// open a new connection. The host counts as pending meanwhile; the
+// wait doesn't count towards the job's timeout.
+func (host *Host) waitToConnect(job *Job) error {
+	if job.Limiter == nil {
+		return nil
+	}
+	debugLogger.Printf("%s: pending", host.Name)
+	return job.Limiter.Wait(host.cancel)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for s, interval := range map[string]time.Duration{
+		"5/s":  200 * time.Millisecond,
+		"4":    250 * time.Millisecond,
+		"30/m": 2 * time.Second,
+		"0.5":  2 * time.Second,
+	} {
+		limiter, err := ParseRate(s)
+		if err != nil {
+			t.Error(s, err)
+			continue
+		}
+		if limiter.interval != interval {
+			t.Error(s, "interval:", limiter.interval)
+		}
+	}
+	for _, s := range []string{"", "0/s", "-1", "5/h", "fast"} {
+		if _, err := ParseRate(s); err == nil {
+			t.Error("accepted:", s)
+		}
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := NewRateLimiter(50 * time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		assert(limiter.Wait(nil))
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Error("not limited:", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := NewRateLimiter(time.Hour)
+	assert(limiter.Wait(nil))
+	cancel := make(chan bool, 1)
+	cancel <- true
+	if err := limiter.Wait(cancel); err != ErrorPending {
+		t.Error("err:", err)
+	}
+}
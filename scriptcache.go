@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Remote directory, relative to $HOME, where scripts are cached by
+// content when the job asks for it. Files are kept once each in
+// "objects", named after a hash of their mode and content. Each
+// script is a directory in "trees", named after the hash of the
+// script, holding a "tree" of hard links to the objects, next to a
+// HASH.complete marker, which also records when the entry was last
+// used. Objects no tree links to anymore are removed.
+const remoteCacheDir = ".judo/cache"
+
+const defaultCacheKeep = 5
+
+// staleCacheClaim is how long an entry may be filled in by a run,
+// before it's considered abandoned, e.g. by a run that was killed.
+const staleCacheClaim = time.Hour
+
+// Hash returns a hash of the script's content: file names, modes,
+// symbolic link targets and file contents, but not timestamps.
+func (script *Script) Hash() (string, error) {
+	staged, err := script.Staged()
+	if err != nil {
+		return "", err
+	}
+	script.m.Lock()
+	defer script.m.Unlock()
+	if script.hash != "" {
+		return script.hash, nil
+	}
+	h := sha256.New()
+	if err := hashTree(h, staged); err != nil {
+		return "", err
+	}
+	script.hash = fmt.Sprintf("%x", h.Sum(nil))
+	return script.hash, nil
+}
+
+func hashTree(h hash.Hash, fname string) error {
+	root := filepath.Dir(fname)
+	return filepath.Walk(fname, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %o\n", filepath.ToSlash(name), info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "-> %q\n", link)
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fmt.Fprintf(h, "%d\n", info.Size())
+			if _, err = io.Copy(h, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// treeEntry is a directory, file or symbolic link in a script, as
+// kept in the remote cache. Name is relative to the script's parent
+// directory; Key names the object holding a file's content.
+type treeEntry struct {
+	Name  string
+	Mode  os.FileMode
+	Link  string
+	Key   string
+	local string
+}
+
+// Tree lists the entries of the script, in the order they need to be
+// created, with the object keys of its files. It is built once, on
+// first use.
+func (script *Script) Tree() ([]treeEntry, error) {
+	staged, err := script.Staged()
+	if err != nil {
+		return nil, err
+	}
+	script.m.Lock()
+	defer script.m.Unlock()
+	if script.tree != nil {
+		return script.tree, nil
+	}
+	var tree []treeEntry
+	root := filepath.Dir(staged)
+	err = filepath.Walk(staged, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entry := treeEntry{
+			Name: filepath.ToSlash(name), Mode: info.Mode(), local: p,
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if entry.Key, err = objectKey(p, info.Mode()); err != nil {
+				return err
+			}
+		}
+		tree = append(tree, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	script.tree = tree
+	return tree, nil
+}
+
+// objectKey returns the name of the object holding the named file: a
+// hash of its mode (as hard links share it) and content.
+func objectKey(fname string, mode os.FileMode) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	fmt.Fprintf(h, "%o\n", mode.Perm())
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// pushScript copies the job's script into the remote directory, going
+// through the remote script cache if the job asks for it. If the
+// cache can't be used, e.g. because another run is filling in the same
+// entry, the script is pushed as usual.
+func (host *Host) pushScript(job *Job, fnameRemote string) error {
+	if !job.ScriptCache {
+		return host.pushStaged(job, fnameRemote)
+	}
+	err := host.pushCached(job, fnameRemote)
+	if err == nil || err == ErrorCancel || err == ErrorPending {
+		return err
+	}
+	host.logger.Printf("script cache: %s; pushing the script", err)
+	return host.pushStaged(job, fnameRemote)
+}
+
+// pushStaged copies the job's script into the remote directory: its
+// Bundle, with --push tar, or else its private, staged copy.
+func (host *Host) pushStaged(job *Job, fnameRemote string) error {
+	if job.Push == pushTar {
+		bundle, err := job.Script.Bundle(job.Compress)
+		if err != nil {
+			return err
+		}
+		return host.pushBundle(job, bundle, fnameRemote)
+	}
+	staged, err := job.Script.Staged()
+	if err != nil {
+		return err
+	}
+	return host.pushFiles(job, staged, fnameRemote)
+}
+
+// pushCached makes sure the job's script is in the remote cache,
+// transferring only the files that are missing there, and copies it
+// from there into the remote directory. Least recently used entries
+// beyond job.CacheKeep are evicted.
+func (host *Host) pushCached(job *Job, fnameRemote string) error {
+	hash, err := job.Script.Hash()
+	if err != nil {
+		return err
+	}
+	tree, err := job.Script.Tree()
+	if err != nil {
+		return err
+	}
+	entry := fmt.Sprintf(`"$HOME"/%s/trees/%s`, remoteCacheDir, hash)
+	var keys bytes.Buffer
+	for _, e := range tree {
+		if e.Key != "" {
+			fmt.Fprintln(&keys, e.Key)
+		}
+	}
+	now := time.Now().Unix()
+	lines, err := host.readLinesInput(job, host.cmdline(fmt.Sprintf(
+		cacheProbeScript, remoteCacheDir, entry,
+		now-int64(staleCacheClaim.Seconds()), now,
+	)), &keys)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("no response from remote cache")
+	}
+	switch lines[0] {
+	case "hit":
+	case "busy":
+		return fmt.Errorf("%s is being filled in by another run", hash)
+	case "miss":
+		debugLogger.Printf("%s: caching %s, %d files missing",
+			host.Name, hash, len(lines)-1)
+		if err = host.fillCache(job, entry, tree, lines[1:]); err != nil {
+			host.Exec(job, fmt.Sprintf(`rm -rf %s`, entry))
+			return err
+		}
+	default:
+		return fmt.Errorf("unexpected response from remote cache: %s", lines[0])
+	}
+	return host.Exec(job, fmt.Sprintf(
+		cacheCopyScript, remoteCacheDir, entry, shquote(fnameRemote),
+		job.CacheKeep, now-int64(staleCacheClaim.Seconds()),
+	))
+}
+
+// cacheProbeScript reads the keys of the script's objects, and tells
+// whether the entry (2) is a "hit", or a "miss" (followed by the keys
+// of the missing objects), in which case this run fills it in; or
+// whether it's "busy" being filled in by another run. Claims older
+// than (3) are abandoned; new claims are stamped with the time (4).
+const cacheProbeScript = `
+c="$HOME"/%[1]s
+e=%[2]s
+mkdir -p "$c"/objects "$c"/trees || exit
+if [ -f "$e.complete" ]; then
+	: > "$e.complete"
+	echo hit
+	exit 0
+fi
+if read -r t 2> /dev/null < "$e/.claimed" && [ "$t" -lt %[3]d ]; then
+	rm -rf "$e"
+fi
+if ! mkdir "$e" 2> /dev/null; then
+	echo busy
+	exit 0
+fi
+echo %[4]d > "$e/.claimed"
+echo miss
+cd "$c"/objects || exit
+while read -r k; do
+	[ -f "$k" ] || echo "$k"
+done
+`
+
+// cacheCopyScript copies the entry (2) into the remote directory (3),
+// and evicts entries beyond the most recently used (4), abandoned
+// claims (older than 5), and the objects no entry links to anymore.
+const cacheCopyScript = `
+c="$HOME"/%[1]s
+cp -RP %[2]s/tree/. %[3]s || exit
+cd "$c"/trees || exit 0
+i=0
+for f in $(ls -t); do
+	case $f in
+	*.complete)
+		i=$((i + 1))
+		[ $i -gt %[4]d ] && rm -rf -- "${f%%.complete}" "$f"
+		;;
+	*)
+		[ -f "$f.complete" ] && continue
+		if read -r t 2> /dev/null < "$f/.claimed" && [ "$t" -lt %[5]d ]; then
+			rm -rf -- "$f"
+		fi
+		;;
+	esac
+done
+cd "$c"/objects || exit 0
+ls -l | while read -r mode links rest; do
+	case $mode in -*) ;; *) continue ;; esac
+	[ "$links" = 1 ] && rm -f -- "${rest##* }"
+done
+exit 0
+`
+
+// fillCache sends the missing objects into the claimed entry, builds
+// the script's tree there out of hard links to the objects, adds the
+// new objects to the cache, and marks the entry complete.
+func (host *Host) fillCache(job *Job, entry string,
+	tree []treeEntry, missing []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "set -e\ncd %s\n", entry)
+	if len(missing) > 0 {
+		dir, err := os.MkdirTemp("", "judo.")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		incoming := path.Join(dir, ".incoming")
+		if err = stageObjects(incoming, tree, missing); err != nil {
+			return err
+		}
+		remote, err := host.ExecRead(job, fmt.Sprintf(`cd %s && pwd`, entry))
+		if err != nil {
+			return err
+		}
+		if err = host.pushFiles(job, incoming, remote); err != nil {
+			return err
+		}
+	}
+	b.WriteString("mkdir tree\n")
+	for _, e := range tree {
+		dst := shquote(path.Join("tree", e.Name))
+		switch {
+		case e.Mode.IsDir():
+			fmt.Fprintf(&b, "mkdir -p %s\n", dst)
+		case e.Link != "":
+			fmt.Fprintf(&b, "ln -s %s %s\n", shquote(e.Link), dst)
+		case e.Key != "":
+			fmt.Fprintf(&b,
+				"ln .incoming/%[1]s %[2]s 2> /dev/null || ln \"$HOME\"/%[3]s/objects/%[1]s %[2]s\n",
+				e.Key, dst, remoteCacheDir)
+		}
+	}
+	fmt.Fprintf(&b, `if [ -d .incoming ]; then
+	for k in .incoming/*; do
+		ln "$k" "$HOME"/%s/objects/ 2> /dev/null || :
+	done
+	rm -r .incoming
+fi
+: > "$PWD.complete"
+`, remoteCacheDir)
+	_, err := host.readLinesInput(job, host.cmdline("sh -s"),
+		strings.NewReader(b.String()))
+	return err
+}
+
+// stageObjects fills the local directory with the files of the tree
+// whose objects are missing, named after their keys: hard links, if
+// possible, or copies.
+func stageObjects(dir string, tree []treeEntry, missing []string) error {
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	want := make(map[string]bool)
+	for _, key := range missing {
+		want[key] = true
+	}
+	for _, e := range tree {
+		if !want[e.Key] {
+			continue
+		}
+		delete(want, e.Key)
+		dst := path.Join(dir, e.Key)
+		if os.Link(e.local, dst) == nil {
+			continue
+		}
+		data, err := os.ReadFile(e.local)
+		if err != nil {
+			return err
+		}
+		if err = os.WriteFile(dst, data, e.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if len(want) > 0 {
+		return fmt.Errorf("remote cache asked for unknown objects")
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScriptHash(t *testing.T) {
+	dir := makeTestBundle(t)
+	script, err := NewScript(dir)
+	assert(err)
+	hash1, err := script.Hash()
+	assert(err)
+
+	// same content, different timestamps
+	script, err = NewScript(dir)
+	assert(err)
+	assert(os.Chtimes(path.Join(dir, "data"), time.Unix(0, 0), time.Unix(0, 0)))
+	hash2, err := script.Hash()
+	assert(err)
+	if hash1 != hash2 {
+		t.Error("hash depends on timestamps")
+	}
+
+	script, err = NewScript(dir)
+	assert(err)
+	assert(os.Chmod(path.Join(dir, "data"), 0600))
+	hash3, err := script.Hash()
+	assert(err)
+	if hash3 == hash1 {
+		t.Error("hash ignores modes")
+	}
+
+	script, err = NewScript(dir)
+	assert(err)
+	assert(os.WriteFile(path.Join(dir, "data"), []byte("world"), 0600))
+	hash4, err := script.Hash()
+	assert(err)
+	if hash4 == hash3 {
+		t.Error("hash ignores content")
+	}
+}
+
+func remoteCacheEntries(t *testing.T) (names []string) {
+	entries, err := os.ReadDir(path.Join(os.Getenv("HOME"), remoteCacheDir, "trees"))
+	assert(err)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return
+}
+
+func TestHostSendRemoteAndRunScriptCache(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript(makeTestBundle(t))
+	assert(err)
+	hash, err := script.Hash()
+	assert(err)
+	for i, data := range []string{"hello", "cached"} {
+		host.Output = nil
+		job := newTestJob(script, nil)
+		job.ScriptCache = true
+		if err = host.SendRemoteAndRun(job); err != nil {
+			t.Error(err)
+			return
+		}
+		if len(host.Output) != 3 || host.Output[0] != "link -> "+data {
+			t.Error("output:", host.Output)
+		}
+		// tamper with the cached copy; the next run should use it
+		if i == 0 {
+			assert(os.WriteFile(path.Join(
+				os.Getenv("HOME"), remoteCacheDir, "trees", hash, "tree", "bundle", "data",
+			), []byte("cached"), 0644))
+		}
+	}
+	entries := remoteCacheEntries(t)
+	if len(entries) != 1 || entries[0] != hash {
+		t.Error("cache entries:", entries)
+	}
+}
+
+func TestHostSendRemoteAndRunScriptCacheEvict(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	var last string
+	for i := 0; i < 3; i++ {
+		fname := path.Join(t.TempDir(), "hello.sh")
+		assert(os.WriteFile(fname, []byte(
+			"#!/bin/sh\necho "+strings.Repeat("!", i+1)+"\n"), 0755))
+		script, err := NewScript(fname)
+		assert(err)
+		job := newTestJob(script, nil)
+		job.ScriptCache = true
+		job.CacheKeep = 2
+		if err = host.SendRemoteAndRun(job); err != nil {
+			t.Error(err)
+			return
+		}
+		last, err = script.Hash()
+		assert(err)
+	}
+	entries := remoteCacheEntries(t)
+	if len(entries) != 2 {
+		t.Error("cache entries:", entries)
+	}
+	found := false
+	for _, entry := range entries {
+		found = found || entry == last
+	}
+	if !found {
+		t.Error("most recent script evicted")
+	}
+	objects, err := os.ReadDir(path.Join(os.Getenv("HOME"), remoteCacheDir, "objects"))
+	assert(err)
+	if len(objects) != 2 {
+		t.Error("objects of evicted scripts kept:", len(objects))
+	}
+}
+
+// countingTransport counts the files pushed through it.
+type countingTransport struct {
+	Transport
+	pushed int
+}
+
+func (t *countingTransport) Push(job *Job, local string, remote string) (*Proc, error) {
+	filepath.Walk(local, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			t.pushed++
+		}
+		return nil
+	})
+	return t.Transport.Push(job, local, remote)
+}
+
+func TestHostScriptCacheMissingFiles(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	transport := &countingTransport{Transport: host.transport}
+	host.transport = transport
+	dir := makeTestBundle(t)
+	for i, expect := range []int{3, 1, 0} {
+		if i == 1 {
+			assert(os.WriteFile(path.Join(dir, "data"), []byte("changed"), 0644))
+		}
+		transport.pushed = 0
+		script, err := NewScript(dir)
+		assert(err)
+		job := newTestJob(script, nil)
+		job.ScriptCache = true
+		if err = host.SendRemoteAndRun(job); err != nil {
+			t.Error(err)
+			return
+		}
+		if transport.pushed != expect {
+			t.Errorf("run %d: pushed %d files, expected %d", i, transport.pushed, expect)
+		}
+	}
+	objects, err := os.ReadDir(path.Join(os.Getenv("HOME"), remoteCacheDir, "objects"))
+	assert(err)
+	if len(objects) != 4 {
+		t.Error("objects:", len(objects))
+	}
+}
+
+func TestHostScriptCacheClaimed(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript(makeTestBundle(t))
+	assert(err)
+	hash, err := script.Hash()
+	assert(err)
+	entry := path.Join(os.Getenv("HOME"), remoteCacheDir, "trees", hash)
+	for _, c := range []struct {
+		claimed time.Time
+		cached  bool
+	}{
+		// another run is filling in the entry; leave it alone
+		{time.Now(), false},
+		// the other run was killed a long time ago
+		{time.Now().Add(-2 * staleCacheClaim), true},
+	} {
+		assert(os.RemoveAll(entry))
+		assert(os.MkdirAll(entry, 0755))
+		assert(os.WriteFile(path.Join(entry, ".claimed"),
+			[]byte(fmt.Sprintf("%d\n", c.claimed.Unix())), 0644))
+		host.Output = nil
+		job := newTestJob(script, nil)
+		job.ScriptCache = true
+		if err = host.SendRemoteAndRun(job); err != nil {
+			t.Error(err)
+			return
+		}
+		if len(host.Output) != 3 || host.Output[0] != "link -> hello" {
+			t.Error("output:", host.Output)
+		}
+		if _, err = os.Stat(entry + ".complete"); (err == nil) != c.cached {
+			t.Error("claimed entry cached:", err == nil)
+		}
+	}
+}
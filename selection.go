@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Selection picks a subset of the hosts in the inventory: either the
+// first Count hosts, or a random sample of Count hosts, or Percent
+// percent of the hosts.
+type Selection struct {
+	Count   int
+	Percent float64
+	Random  bool
+	Seed    int64
+	total   int
+}
+
+// ParseSample parses a sample size, given either as a host count
+// ("5") or as a percentage ("5%").
+func ParseSample(s string) (count int, percent float64, err error) {
+	if strings.HasSuffix(s, "%") {
+		percent, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("bad sample size: %s", s)
+		}
+		return 0, percent, nil
+	}
+	count, err = strconv.Atoi(s)
+	if err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("bad sample size: %s", s)
+	}
+	return count, 0, nil
+}
+
+// size returns how many hosts to pick out of total.
+func (sel *Selection) size(total int) int {
+	n := sel.Count
+	if sel.Percent > 0 {
+		n = int(math.Ceil(float64(total) * sel.Percent / 100))
+	}
+	if n > total {
+		n = total
+	}
+	return n
+}
+
+// Apply picks the selected hosts, keeping their original order.
+func (sel *Selection) Apply(hosts []*Host) []*Host {
+	sel.total = len(hosts)
+	n := sel.size(len(hosts))
+	if !sel.Random {
+		return hosts[:n]
+	}
+	picked := rand.New(rand.NewSource(sel.Seed)).Perm(len(hosts))[:n]
+	sort.Ints(picked)
+	out := make([]*Host, n)
+	for i, j := range picked {
+		out[i] = hosts[j]
+	}
+	return out
+}
+
+// String describes the selection, as applied.
+func (sel *Selection) String() string {
+	n := sel.size(sel.total)
+	if !sel.Random {
+		return fmt.Sprintf("first %d of %d", n, sel.total)
+	}
+	return fmt.Sprintf("sample %d of %d, seed %d", n, sel.total, sel.Seed)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testHosts(n int) (hosts []*Host) {
+	for i := 0; i < n; i++ {
+		host, err := NewHost(fmt.Sprintf("host%02d", i))
+		assert(err)
+		hosts = append(hosts, host)
+	}
+	return
+}
+
+func TestParseSample(t *testing.T) {
+	count, percent, err := ParseSample("5")
+	if err != nil || count != 5 || percent != 0 {
+		t.Error("5:", count, percent, err)
+	}
+	count, percent, err = ParseSample("12.5%")
+	if err != nil || count != 0 || percent != 12.5 {
+		t.Error("12.5%:", count, percent, err)
+	}
+	for _, s := range []string{"0", "-1", "0%", "101%", "x"} {
+		if _, _, err := ParseSample(s); err == nil {
+			t.Error("accepted:", s)
+		}
+	}
+}
+
+func TestSelectionFirst(t *testing.T) {
+	sel := &Selection{Count: 3}
+	hosts := sel.Apply(testHosts(10))
+	if len(hosts) != 3 || hosts[0].Name != "host00" || hosts[2].Name != "host02" {
+		t.Error("hosts:", hosts)
+	}
+	if sel.String() != "first 3 of 10" {
+		t.Error("string:", sel)
+	}
+}
+
+func TestSelectionSample(t *testing.T) {
+	sel := &Selection{Percent: 25, Random: true, Seed: 42}
+	hosts := sel.Apply(testHosts(10))
+	if len(hosts) != 3 {
+		t.Error("len:", len(hosts))
+		return
+	}
+	for i := 1; i < len(hosts); i++ {
+		if hosts[i-1].Name >= hosts[i].Name {
+			t.Error("order not kept")
+		}
+	}
+	again := (&Selection{Percent: 25, Random: true, Seed: 42}).Apply(testHosts(10))
+	for i := range hosts {
+		if hosts[i].Name != again[i].Name {
+			t.Error("same seed, different sample")
+		}
+	}
+}
+
+func TestSelectionTooMany(t *testing.T) {
+	sel := &Selection{Count: 5, Random: true}
+	if hosts := sel.Apply(testHosts(2)); len(hosts) != 2 {
+		t.Error("len:", len(hosts))
+	}
+}
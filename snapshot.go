@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot is the output of a job on a single host, kept in the
+// state directory for later comparison.
+type Snapshot struct {
+	Taken   time.Time `json:"taken"`
+	Command string    `json:"command"`
+	Output  []string  `json:"output"`
+}
+
+// CheckSnapshotName reports an error if the snapshot name can't be
+// used as the name of a directory in the state directory.
+func CheckSnapshotName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/.") {
+		return fmt.Errorf("bad snapshot name: %s", name)
+	}
+	return nil
+}
+
+func snapshotStateName(name, host string) string {
+	return path.Join("snapshots", name, host+".json")
+}
+
+// SaveSnapshot stores the output recorded on the host under the
+// given snapshot name.
+func SaveSnapshot(name string, job *Job, host *Host) error {
+	var command string
+	if job.Command != nil {
+		command = job.Command.cmd
+	} else if job.Script != nil {
+		command = job.Script.fname
+	}
+	return writeState(snapshotStateName(name, host.Name), Snapshot{
+		Taken:   time.Now(),
+		Command: command,
+		Output:  host.Output,
+	})
+}
+
+// ClearSnapshot removes the per-host snapshots stored under the given
+// name, so that saving it again doesn't leave behind the hosts that
+// are no longer there.
+func ClearSnapshot(name string) error {
+	if err := CheckSnapshotName(name); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(stateDir(), "snapshots", name))
+}
+
+// LoadSnapshots reads the per-host snapshots stored under the given
+// name.
+func LoadSnapshots(name string) (map[string]*Snapshot, error) {
+	if err := CheckSnapshotName(name); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(path.Join(stateDir(), "snapshots", name))
+	if err != nil {
+		return nil, fmt.Errorf("no such snapshot: %s", name)
+	}
+	snapshots := make(map[string]*Snapshot)
+	for _, entry := range entries {
+		host := strings.TrimSuffix(entry.Name(), ".json")
+		if host == entry.Name() {
+			continue
+		}
+		snapshot := &Snapshot{}
+		if err = readState(snapshotStateName(name, host), snapshot); err != nil {
+			return nil, err
+		}
+		snapshots[host] = snapshot
+	}
+	return snapshots, nil
+}
+
+// CompareSnapshots reports the hosts whose output differs between the
+// two named snapshots, together with the differences. It returns
+// whether any differences were found.
+func CompareSnapshots(name1, name2 string) (report string, changed bool, err error) {
+	before, err := LoadSnapshots(name1)
+	if err != nil {
+		return "", false, err
+	}
+	after, err := LoadSnapshots(name2)
+	if err != nil {
+		return "", false, err
+	}
+	hosts := make(map[string]bool)
+	for host := range before {
+		hosts[host] = true
+	}
+	for host := range after {
+		hosts[host] = true
+	}
+	var names []string
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return "No hosts in either snapshot", false, nil
+	}
+
+	var b strings.Builder
+	var unchanged, missing, added []string
+	for _, host := range names {
+		switch {
+		case after[host] == nil:
+			missing = append(missing, host)
+		case before[host] == nil:
+			added = append(added, host)
+		default:
+			diff := diffLines(before[host].Output, after[host].Output)
+			if len(diff) == 0 {
+				unchanged = append(unchanged, host)
+				continue
+			}
+			fmt.Fprintf(&b, "Changed: %s\n", host)
+			for _, line := range diff {
+				fmt.Fprintf(&b, "    %s\n", line)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(&b, "Only in %s: %v\n", name1, missing)
+	}
+	if len(added) > 0 {
+		fmt.Fprintf(&b, "Only in %s: %v\n", name2, added)
+	}
+	if len(unchanged) > 0 {
+		fmt.Fprintf(&b, "Unchanged: %v\n", unchanged)
+	}
+	changed = len(unchanged) != len(names)
+	return strings.TrimSuffix(b.String(), "\n"), changed, nil
+}
+
+// diffLines compares two lists of lines, and returns the removed
+// lines prefixed with "- ", and the added lines prefixed with "+ ",
+// in order. Returns nothing if the lists are equal.
+func diffLines(a, b []string) (diff []string) {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+ "+b[j])
+	}
+	return
+}
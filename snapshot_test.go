@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	if diff := diffLines([]string{"a", "b"}, []string{"a", "b"}); len(diff) != 0 {
+		t.Error("diff of equal lines:", diff)
+	}
+	diff := diffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"})
+	if strings.Join(diff, "|") != "- b|+ x|+ d" {
+		t.Error("diff:", diff)
+	}
+}
+
+func TestCompareSnapshots(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	job := &Job{Command: NewCommand("uname -r")}
+	for name, outputs := range map[string]map[string]string{
+		"before": {"web1": "5.10", "web2": "5.10", "web3": "5.10"},
+		"after":  {"web1": "5.10", "web2": "6.1", "web4": "6.1"},
+	} {
+		for host, output := range outputs {
+			h, err := NewHost(host)
+			assert(err)
+			h.Output = []string{output}
+			assert(SaveSnapshot(name, job, h))
+		}
+	}
+	report, changed, err := CompareSnapshots("before", "after")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !changed {
+		t.Error("no changes reported")
+	}
+	expect := `Changed: web2
+    - 5.10
+    + 6.1
+Only in before: [web3]
+Only in after: [web4]
+Unchanged: [web1]`
+	if report != expect {
+		t.Error("report:\n" + report)
+	}
+	if _, _, err = CompareSnapshots("before", "nope"); err == nil {
+		t.Error("no error for missing snapshot")
+	}
+	if _, _, err = CompareSnapshots("..", "after"); err == nil {
+		t.Error("no error for bad snapshot name")
+	}
+
+	// saving again replaces the snapshot as a whole
+	assert(ClearSnapshot("after"))
+	h, err := NewHost("web1")
+	assert(err)
+	h.Output = []string{"5.10"}
+	assert(SaveSnapshot("after", job, h))
+	after, err := LoadSnapshots("after")
+	if err != nil || len(after) != 1 || after["web1"] == nil {
+		t.Error("stale hosts in snapshot:", after, err)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// sshControlPath is shared by all runs, for persistent masters.
+	// Otherwise, each run keeps its masters' sockets in a private
+	// directory (see Job.MakeControlDir).
+	sshControlPath      = "~/.ssh/judo-control-%C"
+	sshBatchOpt         = "-o BatchMode=yes"
+	sshControlMasterOpt = "-o ControlMaster=no"
+)
+
+// judoSSHVarOptions maps judo's own connection vars, as found in the
+// inventory, to ssh(1) options.
+var judoSSHVarOptions = map[string]string{
+	"judo_ssh_proxy_jump":    "ProxyJump",
+	"judo_ssh_port":          "Port",
+	"judo_ssh_user":          "User",
+	"judo_ssh_identity_file": "IdentityFile",
+}
+
+// sshVarOptions maps Ansible connection vars, as found in the
+// inventory, to ssh(1) options.
+var sshVarOptions = map[string]string{
+	"ansible_host":                 "HostName",
+	"ansible_ssh_host":             "HostName",
+	"ansible_port":                 "Port",
+	"ansible_ssh_port":             "Port",
+	"ansible_user":                 "User",
+	"ansible_ssh_user":             "User",
+	"ansible_ssh_private_key_file": "IdentityFile",
+}
+
+// sshArgsFromVars turns connection vars into ssh(1)/scp(1) arguments.
+// Since ssh(1) uses the first value it's given for each option, the
+// order is: judo's own vars (judo_ssh_*, then the "-o" options from
+// judo_ssh_options), then Ansible's. Host vars override group vars
+// before they get here.
+func sshArgsFromVars(vars map[string]string) (args []string) {
+	args = append(args, optionsFromVars(vars, judoSSHVarOptions)...)
+	if fields, err := splitFields(vars["judo_ssh_options"]); err == nil {
+		for _, field := range fields {
+			args = append(args, "-o", field)
+		}
+	}
+	args = append(args, optionsFromVars(vars, sshVarOptions)...)
+	for _, key := range []string{
+		"ansible_ssh_common_args", "ansible_ssh_extra_args",
+	} {
+		if fields, err := splitFields(vars[key]); err == nil {
+			args = append(args, fields...)
+		}
+	}
+	return
+}
+
+// optionsFromVars turns the vars named in options into "-o" options,
+// in order of var name.
+func optionsFromVars(vars map[string]string, options map[string]string) (args []string) {
+	var keys []string
+	for key := range vars {
+		if _, ok := options[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "-o", fmt.Sprintf("%s=%s", options[key], vars[key]))
+	}
+	return
+}
+
+// connectArgs returns the ssh(1)/scp(1) options for the user and
+// port the host was named with.
+func (host *Host) connectArgs() (args []string) {
+	if host.User != "" {
+		args = append(args, "-o", "User="+host.User)
+	}
+	if host.Port != 0 {
+		args = append(args, "-o", fmt.Sprintf("Port=%d", host.Port))
+	}
+	return
+}
+
+// sshTransport reaches the host with the OpenSSH ssh(1) and scp(1)
+// binaries, multiplexing the connections through a master process.
+// If the master can't be set up, it falls back to direct connections.
+type sshTransport struct {
+	host       *Host
+	master     *Proc
+	persistent bool
+	direct     bool
+	connected  bool
+	knownHosts []string
+	knownOnce  sync.Once
+}
+
+// sshArgs returns the ssh(1)/scp(1) options for reaching the host:
+// its user and port, judo's known_hosts, if the job uses it, and the
+// host's own options.
+func (t *sshTransport) sshArgs(job *Job) (args []string) {
+	if job.KnownHosts {
+		t.knownOnce.Do(func() {
+			t.knownHosts = t.host.knownHostsArgs()
+		})
+	}
+	args = append(args, t.host.connectArgs()...)
+	args = append(args, t.knownHosts...)
+	return append(args, t.host.SshArgs...)
+}
+
+// controlPath returns the path of the master's socket: in the job's
+// private control directory, under a short name, so that it fits in
+// the limits of a socket path; or the shared one, for persistent
+// masters.
+func (t *sshTransport) controlPath(job *Job) string {
+	if job.Persist > 0 || job.ControlDir == "" {
+		return sshControlPath
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf(
+		"%s %s %s %d", t.host.Name, t.host.Address, t.host.User, t.host.Port,
+	)))
+	return path.Join(job.ControlDir, fmt.Sprintf("%x", sum[:5]))
+}
+
+// muxArgs returns the ssh(1)/scp(1) options for connecting through
+// the master, or directly, if there is no master.
+func (t *sshTransport) muxArgs(job *Job) []string {
+	if t.direct {
+		return []string{"-o", "ControlPath=none"}
+	}
+	return []string{"-o", "ControlPath=" + t.controlPath(job), sshControlMasterOpt}
+}
+
+// controlArgs returns the ssh(1) options for talking to the master.
+func (t *sshTransport) controlArgs(job *Job) (args []string) {
+	args = append(args, t.sshArgs(job)...)
+	return append(args, sshBatchOpt, "-o", "ControlPath="+t.controlPath(job))
+}
+
+// Push copies files with scp(1).
+func (t *sshTransport) Push(job *Job, local string, remote string) (*Proc, error) {
+	host := t.host
+	if !t.connected {
+		if err := host.waitToConnect(job); err != nil {
+			return nil, err
+		}
+	}
+	scpArgs := t.sshArgs(job)
+	scpArgs = append(scpArgs, sshBatchOpt)
+	scpArgs = append(scpArgs, t.muxArgs(job)...)
+	scpArgs = append(
+		scpArgs,
+		"-r",
+		local,
+		fmt.Sprintf("[%s]:%s", host.Address, remote),
+	)
+	return NewProc("scp", scpArgs...)
+}
+
+// Run runs the command line with ssh(1). Unless there is a master to
+// go through, this opens a new connection, subject to the job's rate
+// limit.
+func (t *sshTransport) Run(job *Job, cmdline string, stdin io.Reader) (*Proc, error) {
+	host := t.host
+	if !t.connected {
+		if err := host.waitToConnect(job); err != nil {
+			return nil, err
+		}
+	}
+	var sshArgs []string
+	if job.ConnectTimeout > 0 {
+		// ssh(1) only takes whole seconds, and 0 means no timeout
+		sshArgs = append(sshArgs, "-o", fmt.Sprintf("ConnectTimeout=%d",
+			(job.ConnectTimeout+time.Second-1)/time.Second))
+	}
+	sshArgs = append(sshArgs, t.sshArgs(job)...)
+	sshArgs = append(sshArgs, sshBatchOpt)
+	sshArgs = append(sshArgs, t.muxArgs(job)...)
+	sshArgs = append(sshArgs, host.Address, cmdline)
+	if stdin != nil {
+		return NewProcInput(stdin, "ssh", sshArgs...)
+	}
+	return NewProc("ssh", sshArgs...)
+}
+
+// Connect starts the SSH master process for this host, to speed up
+// execution of consecutive SSH requests, and waits until it's ready.
+// If the job asks for it, the master persists after the job is done,
+// to be reused by later runs. If the master can't be set up, the
+// transport falls back to direct connections, and the reason is
+// recorded in the host's warnings.
+func (t *sshTransport) Connect(job *Job) (err error) {
+	if runtime.GOOS == "windows" {
+		// Master process on Windows seems problematic
+		return nil
+	}
+	if job.Persist > 0 {
+		err = t.connectPersistent(job)
+	} else {
+		err = t.connectMaster(job)
+	}
+	if err == ErrorPending {
+		return err
+	}
+	if err != nil {
+		t.fallback(err)
+	}
+	return nil
+}
+
+// connectMaster starts the master process, which lives as long as
+// the transport.
+func (t *sshTransport) connectMaster(job *Job) error {
+	if t.master != nil && t.master.IsAlive() {
+		panic("there already is a master")
+	}
+	host := t.host
+	if err := host.waitToConnect(job); err != nil {
+		return err
+	}
+	sshArgs := t.controlArgs(job)
+	sshArgs = append(sshArgs, "-MN", host.Address)
+	proc, err := NewProc("ssh", sshArgs...)
+	if err != nil {
+		return err
+	}
+	t.master = proc
+	// the master doesn't need input; closing it lets us notice when
+	// the master exits
+	close(proc.Stdin())
+	exited := make(chan error, 1)
+	var reason string
+	go func() {
+		for {
+			select {
+			case line, ok := <-proc.Stdout():
+				if !ok {
+					continue
+				}
+				host.logger.Println(line)
+			case line, ok := <-proc.Stderr():
+				if !ok {
+					continue
+				}
+				host.logger.Println(line)
+				reason = line
+			case err := <-proc.Done():
+				if err != nil {
+					host.logger.Println(err.Error())
+					if reason != "" {
+						err = fmt.Errorf("%s", reason)
+					}
+				} else {
+					err = fmt.Errorf("master exited")
+				}
+				exited <- err
+				return
+			case <-host.cancel:
+				// this master is the transport's own; once it's
+				// gone, Close knows by its Proc
+				proc.Signal(os.Interrupt)
+			}
+		}
+	}()
+	if err = t.waitReady(job, exited); err != nil {
+		return err
+	}
+	t.connected = true
+	return nil
+}
+
+// waitReady waits until the master answers "ssh -O check", gives up,
+// or exits.
+func (t *sshTransport) waitReady(job *Job, exited <-chan error) error {
+	deadline := time.After(job.Timeout)
+	for {
+		if t.control(job, "check") == nil {
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return err
+		case <-deadline:
+			t.Close()
+			return fmt.Errorf("master not ready after %s", job.Timeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// control sends the given control command (e.g. "check") to the
+// master.
+func (t *sshTransport) control(job *Job, command string) error {
+	args := t.controlArgs(job)
+	args = append(args, "-O", command, t.host.Address)
+	return exec.Command("ssh", args...).Run()
+}
+
+// fallback switches the transport to direct connections, because of
+// the given problem with the master.
+func (t *sshTransport) fallback(err error) {
+	msg := fmt.Sprintf("master connection failed: %s; using direct connections", err)
+	t.host.logger.Println(msg)
+	t.host.Warnings = append(t.host.Warnings, msg)
+	t.direct = true
+	t.persistent = false
+	t.connected = false
+}
+
+// Close kills the master process, unless it's meant to persist.
+func (t *sshTransport) Close() error {
+	if t.persistent || t.direct {
+		return nil
+	}
+	master := t.master
+	if master == nil || !master.IsAlive() {
+		t.host.logger.Println("there was no master to stop")
+		return nil
+	}
+	return master.Signal(os.Interrupt)
+}
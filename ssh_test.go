@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSSH puts an ssh(1) stand-in first in PATH. It logs its
+// arguments, runs commands locally, and handles the master (-MN) and
+// control (-O) requests with the given shell snippets.
+//
+// A master that works: fakeMaster, fakeCheck.
+func fakeSSH(t *testing.T, master, control string) (logfile string) {
+	dir := t.TempDir()
+	logfile = path.Join(dir, "log")
+	assert(os.WriteFile(path.Join(dir, "ssh"), []byte(`#!/bin/sh
+echo "$*" >> `+shquote(logfile)+`
+for a; do
+	case "$a" in
+	-MN) `+master+`;;
+	-O) `+control+`;;
+	esac
+	last="$a"
+done
+exec sh -c "$last"
+`), 0755))
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	return
+}
+
+const (
+	fakeMaster = `touch "$0.ready"; exec sleep 30`
+	fakeCheck  = `test -e "$0.ready"; exit`
+)
+
+func newSSHHost(t *testing.T) *Host {
+	host, err := NewHost("localhost")
+	assert(err)
+	host.logger.SetOutput(&strings.Builder{})
+	return host
+}
+
+func readLog(t *testing.T, logfile string) string {
+	b, err := os.ReadFile(logfile)
+	assert(err)
+	return string(b)
+}
+
+func TestSSHTransportMaster(t *testing.T) {
+	logfile := fakeSSH(t, fakeMaster, fakeCheck)
+	host := newSSHHost(t)
+	job := newTestJob(nil, NewCommand("true"))
+	assert(host.transport.Connect(job))
+	defer host.transport.Close()
+	if len(host.Warnings) != 0 {
+		t.Error("warnings:", host.Warnings)
+	}
+	if err := host.Exec(job, "echo hi"); err != nil {
+		t.Error(err)
+	}
+	log := readLog(t, logfile)
+	if !strings.Contains(log, "-O check") {
+		t.Error("master not checked:", log)
+	}
+	if strings.Contains(log, "ControlPath=none") {
+		t.Error("fell back to direct connection:", log)
+	}
+}
+
+func TestSSHTransportMasterFallback(t *testing.T) {
+	logfile := fakeSSH(t,
+		`echo "unix_listener: path too long" >&2; exit 255`, "exit 255")
+	host := newSSHHost(t)
+	job := newTestJob(nil, NewCommand("true"))
+	assert(host.transport.Connect(job))
+	defer host.transport.Close()
+	if len(host.Warnings) != 1 ||
+		!strings.Contains(host.Warnings[0], "path too long") {
+		t.Error("warnings:", host.Warnings)
+	}
+	if out, err := host.ExecRead(job, "echo hi"); err != nil || out != "hi" {
+		t.Error("output:", out, err)
+	}
+	if !strings.Contains(readLog(t, logfile), "ControlPath=none") {
+		t.Error("no direct connection")
+	}
+}
+
+func TestSSHTransportControlDir(t *testing.T) {
+	logfile := fakeSSH(t, fakeMaster, fakeCheck)
+	host := newSSHHost(t)
+	job := newTestJob(nil, NewCommand("true"))
+	assert(job.MakeControlDir())
+	assert(host.transport.Connect(job))
+	host.transport.Close()
+	if !strings.Contains(readLog(t, logfile), "ControlPath="+job.ControlDir+"/") {
+		t.Error("private control directory not used")
+	}
+	job.Cleanup()
+	if _, err := os.Stat(job.ControlDir); !os.IsNotExist(err) {
+		t.Error("control directory left behind")
+	}
+
+	// persistent masters are shared between runs
+	job.Persist = time.Minute
+	if path := host.transport.(*sshTransport).controlPath(job); path != sshControlPath {
+		t.Error("persistent control path:", path)
+	}
+}
+
+func TestSSHTransportConnectRate(t *testing.T) {
+	fakeSSH(t, fakeMaster, fakeCheck)
+	job := newTestJob(nil, NewCommand("true"))
+	job.Limiter = NewRateLimiter(time.Hour)
+	host := newSSHHost(t)
+	assert(host.transport.Connect(job))
+	defer host.transport.Close()
+
+	// going through the master needs no token
+	if out, err := host.ExecRead(job, "echo hi"); err != nil || out != "hi" {
+		t.Error("output:", out, err)
+	}
+
+	// but another master does
+	other := newSSHHost(t)
+	other.Cancel()
+	if err := other.transport.Connect(job); err != ErrorPending {
+		t.Error("err:", err)
+	}
+}
+
+func TestSSHTransportRunRemoteMaster(t *testing.T) {
+	logfile := fakeSSH(t, fakeMaster, fakeCheck)
+	host := newSSHHost(t)
+	job := newTestJob(nil, NewCommand("echo hi"))
+	if err := host.RunRemote(job); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(readLog(t, logfile), "-MN") {
+		t.Error("no master for the command")
+	}
+	if strings.Join(host.Output, "\n") != "hi" {
+		t.Error("output:", host.Output)
+	}
+}
+
+func TestSSHTransportMasterFallbackResult(t *testing.T) {
+	fakeSSH(t, `echo "unix_listener: path too long" >&2; exit 255`, "exit 255")
+	host := newSSHHost(t)
+	job := newTestJob(nil, NewCommand("true"))
+	job.Inventory.hosts = []*Host{host}
+	result := job.Execute()
+	err := (*result)[host]
+	if Failed(err) || result.ExitStatus() != 0 {
+		t.Error("host failed:", err)
+	}
+	if warnings := Warnings(err); len(warnings) != 1 ||
+		!strings.Contains(warnings[0], "path too long") {
+		t.Error("result:", err)
+	}
+}
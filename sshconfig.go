@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Names starting with this prefix refer to hosts declared in the
+// ssh_config(5) file, e.g. "@sshconfig" or "@sshconfig:web".
+const sshConfigPrefix = "@sshconfig"
+
+// defaultSSHConfig returns the path to the user's ssh_config file.
+func defaultSSHConfig() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".ssh", "config")
+}
+
+// ReadSSHConfig collects hosts from the "Host" lines of an
+// ssh_config(5) file. Patterns (with "*", "?" or "!") are skipped. A
+// "# judo-groups: web prod" comment inside a Host block puts its
+// hosts into the named groups. All hosts are in the "all" group, in
+// the order they were declared.
+func ReadSSHConfig(r io.Reader) (*InventoryFile, error) {
+	file := NewInventoryFile()
+	all := file.group("all")
+	var current []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			comment := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+			if !strings.HasPrefix(comment, "judo-groups:") {
+				continue
+			}
+			groups := strings.Fields(
+				strings.TrimPrefix(comment, "judo-groups:"))
+			for _, group := range groups {
+				g := file.group(group)
+				for _, name := range current {
+					if !contains(g.Hosts, name) {
+						g.Hosts = append(g.Hosts, name)
+					}
+				}
+			}
+			continue
+		}
+		keyword, args := splitSSHConfigLine(line)
+		switch strings.ToLower(keyword) {
+		case "host":
+			current = nil
+			for _, name := range args {
+				if strings.ContainsAny(name, "*?!") {
+					continue
+				}
+				current = append(current, name)
+				if !contains(all.Hosts, name) {
+					all.Hosts = append(all.Hosts, name)
+				}
+			}
+		case "match":
+			current = nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// splitSSHConfigLine splits a line into a keyword and its arguments;
+// the keyword may be separated by whitespace or "=".
+func splitSSHConfigLine(line string) (keyword string, args []string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return line, nil
+	}
+	keyword = line[:i]
+	rest := strings.TrimLeft(line[i:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+	fields, err := splitFields(rest)
+	if err != nil {
+		return keyword, strings.Fields(rest)
+	}
+	return keyword, fields
+}
+
+// sshConfigHosts returns the hosts named by an "@sshconfig" or
+// "@sshconfig:GROUP" name.
+func (inventory *Inventory) sshConfigHosts(name string) ([]string, error) {
+	file, err := inventory.sshConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	group := strings.TrimPrefix(strings.TrimPrefix(name, sshConfigPrefix), ":")
+	if group == "" {
+		group = "all"
+	}
+	if !file.HasGroup(group) {
+		return nil, fmt.Errorf("%s: no such group in %s", name, inventory.SSHConfig)
+	}
+	return file.Groups[group].Hosts, nil
+}
+
+// sshConfigFile reads the ssh_config file, once.
+func (inventory *Inventory) sshConfigFile() (*InventoryFile, error) {
+	inventory.m.Lock()
+	defer inventory.m.Unlock()
+	if inventory.sshConfig != nil {
+		return inventory.sshConfig, nil
+	}
+	f, err := os.Open(inventory.SSHConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	file, err := ReadSSHConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", inventory.SSHConfig, err)
+	}
+	inventory.sshConfig = file
+	return file, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testSSHConfig = `Host *
+    ServerAliveInterval 60
+
+Host web1 web2
+    # judo-groups: web prod
+    User deploy
+
+Host=db1
+    # judo-groups: prod
+    HostName 10.0.0.5
+
+Host bastion !nope
+    User admin
+`
+
+func TestReadSSHConfig(t *testing.T) {
+	file, err := ReadSSHConfig(strings.NewReader(testSSHConfig))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	all := strings.Join(file.Groups["all"].Hosts, " ")
+	if all != "web1 web2 db1 bastion" {
+		t.Error("all:", all)
+	}
+	prod := strings.Join(file.Groups["prod"].Hosts, " ")
+	if prod != "web1 web2 db1" {
+		t.Error("prod:", prod)
+	}
+}
+
+func TestInventoryPopulateSSHConfig(t *testing.T) {
+	fname := path.Join(t.TempDir(), "ssh_config")
+	assert(os.WriteFile(fname, []byte(testSSHConfig), 0644))
+	inventory := NewInventory()
+	inventory.SSHConfig = fname
+	inventory.Populate([]string{"@sshconfig:web", "@sshconfig"})
+	var names []string
+	for host := range inventory.GetHosts() {
+		names = append(names, host.Name)
+	}
+	if strings.Join(names, " ") != "web1 web2 db1 bastion" {
+		t.Error("hosts:", names)
+	}
+}
+
+func TestInventoryPopulateSSHConfigErrors(t *testing.T) {
+	fname := path.Join(t.TempDir(), "ssh_config")
+	assert(os.WriteFile(fname, []byte(testSSHConfig), 0644))
+	inventory := NewInventory()
+	inventory.SSHConfig = fname
+	err := inventory.Populate([]string{"web1", "@sshconfig:typo"})
+	if err == nil || !strings.Contains(err.Error(), "no such group") {
+		t.Error("err:", err)
+	}
+
+	inventory = NewInventory()
+	inventory.SSHConfig = path.Join(t.TempDir(), "missing")
+	if err = inventory.Populate([]string{"@sshconfig"}); err == nil {
+		t.Error("missing ssh_config accepted")
+	}
+}
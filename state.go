@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+)
+
+// stateDir returns the directory where judo keeps local state, such
+// as facts gathered from hosts: $XDG_STATE_HOME/judo, falling back to
+// ~/.local/state/judo.
+func stateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return path.Join(dir, "judo")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path.Join(os.TempDir(), "judo")
+	}
+	return path.Join(home, ".local", "state", "judo")
+}
+
+// readState decodes the JSON state file under the state directory.
+func readState(fname string, v interface{}) error {
+	f, err := os.Open(path.Join(stateDir(), fname))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(v)
+}
+
+// writeState atomically replaces the JSON state file under the state
+// directory.
+func writeState(fname string, v interface{}) error {
+	fname = path.Join(stateDir(), fname)
+	if err := os.MkdirAll(path.Dir(fname), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(path.Dir(fname), "tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "    ")
+	if err = enc.Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
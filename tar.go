@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Ways of pushing files to the remote host.
+const (
+	// pushCopy copies files with the transport's own means (e.g. scp).
+	pushCopy = "copy"
+	// pushTar streams a tar archive to tar(1) on the remote host.
+	pushTar = "tar"
+
+	defaultPushMode = pushCopy
+)
+
+// writeTar writes the named file or directory to w as a tar archive,
+// with entries named relative to the file's parent directory. Modes
+// and symbolic links are preserved; ownership is not.
+func writeTar(w io.Writer, fname string) error {
+	tw := tar.NewWriter(w)
+	root := filepath.Dir(fname)
+	err := filepath.Walk(fname, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
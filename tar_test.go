@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func makeTestBundle(t *testing.T) string {
+	dir := path.Join(t.TempDir(), "bundle")
+	assert(os.Mkdir(dir, 0755))
+	assert(os.WriteFile(path.Join(dir, "script"), []byte(`#!/bin/sh
+cd "$(dirname "$0")"
+[ -L link ] && echo "link -> $(cat link)"
+[ -x tool ] && echo "tool is executable"
+[ -x data ] || echo "data is not executable"
+`), 0755))
+	assert(os.WriteFile(path.Join(dir, "tool"), []byte("#!/bin/sh\n"), 0700))
+	assert(os.WriteFile(path.Join(dir, "data"), []byte("hello"), 0644))
+	assert(os.Symlink("data", path.Join(dir, "link")))
+	return dir
+}
+
+func TestWriteTar(t *testing.T) {
+	dir := makeTestBundle(t)
+	var b bytes.Buffer
+	assert(writeTar(&b, dir))
+	tr := tar.NewReader(&b)
+	seen := make(map[string]*tar.Header)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert(err)
+		seen[hdr.Name] = hdr
+	}
+	if hdr := seen["bundle/"]; hdr == nil || hdr.Typeflag != tar.TypeDir {
+		t.Error("no directory entry")
+	}
+	if hdr := seen["bundle/link"]; hdr == nil || hdr.Linkname != "data" {
+		t.Error("symlink not preserved")
+	}
+	if hdr := seen["bundle/tool"]; hdr == nil || hdr.Mode&0777 != 0700 {
+		t.Error("mode not preserved")
+	}
+}
+
+func TestHostSendRemoteAndRunPushTar(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	script, err := NewScript(makeTestBundle(t))
+	assert(err)
+	job := newTestJob(script, nil)
+	job.Push = pushTar
+	if err = host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	expect := "link -> hello\ntool is executable\ndata is not executable"
+	if strings.Join(host.Output, "\n") != expect {
+		t.Error("output:", host.Output)
+	}
+	assertNoWorkdirs(t)
+}
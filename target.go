@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Target describes how to reach a host, as named on the command line
+// or in the inventory: "host", "user@host", "host:2222",
+// "[2001:db8::1]:22", or "ssh://user@host:port".
+type Target struct {
+	// Name is the host name, used for display and as HOSTNAME: the
+	// address, with the user and port it was given, if any.
+	Name    string
+	Address string
+	User    string
+	Port    int
+}
+
+// ParseTarget parses a target specification.
+func ParseTarget(s string) (target Target, err error) {
+	if strings.HasPrefix(s, "ssh://") {
+		return parseTargetURL(s)
+	}
+	rest := s
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		target.User = rest[:i]
+		rest = rest[i+1:]
+		if target.User == "" {
+			return target, fmt.Errorf("malformed target: %s", s)
+		}
+	}
+	var port string
+	switch {
+	case strings.HasPrefix(rest, "["):
+		i := strings.Index(rest, "]")
+		if i < 0 {
+			return target, fmt.Errorf("malformed target: %s", s)
+		}
+		target.Address = rest[1:i]
+		rest = rest[i+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return target, fmt.Errorf("malformed target: %s", s)
+			}
+			port = rest[1:]
+		}
+	case strings.Count(rest, ":") > 1:
+		// bare IPv6 address, no port
+		target.Address = rest
+	case strings.Contains(rest, ":"):
+		i := strings.Index(rest, ":")
+		target.Address, port = rest[:i], rest[i+1:]
+	default:
+		target.Address = rest
+	}
+	if target.Address == "" || strings.ContainsAny(target.Address, "@[]/ ") {
+		return target, fmt.Errorf("malformed target: %s", s)
+	}
+	if strings.HasSuffix(s, ":") {
+		return target, fmt.Errorf("malformed target: %s", s)
+	}
+	if target.Port, err = parsePort(port); err != nil {
+		return target, fmt.Errorf("malformed target: %s", s)
+	}
+	target.Name = target.displayName()
+	return target, nil
+}
+
+func parseTargetURL(s string) (target Target, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return target, fmt.Errorf("malformed target: %s", s)
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.Fragment != "" {
+		return target, fmt.Errorf("malformed target: %s", s)
+	}
+	if u.User != nil {
+		target.User = u.User.Username()
+	}
+	target.Address = u.Hostname()
+	if target.Address == "" {
+		return target, fmt.Errorf("malformed target: %s", s)
+	}
+	if target.Port, err = parsePort(u.Port()); err != nil {
+		return target, fmt.Errorf("malformed target: %s", s)
+	}
+	target.Name = target.displayName()
+	return target, nil
+}
+
+// displayName spells out the target in its short form, so that only
+// the same address, user and port make the same name.
+func (target Target) displayName() string {
+	name := target.Address
+	if target.Port != 0 {
+		if strings.Contains(name, ":") {
+			name = "[" + name + "]"
+		}
+		name = fmt.Sprintf("%s:%d", name, target.Port)
+	}
+	if target.User != "" {
+		name = target.User + "@" + name
+	}
+	return name
+}
+
+func parsePort(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("bad port: %s", s)
+	}
+	return port, nil
+}
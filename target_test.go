@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTarget(t *testing.T) {
+	for s, expect := range map[string]Target{
+		"host":                       {"host", "host", "", 0},
+		"user@host":                  {"user@host", "host", "user", 0},
+		"host:2222":                  {"host:2222", "host", "", 2222},
+		"user@host:2222":             {"user@host:2222", "host", "user", 2222},
+		"2001:db8::1":                {"2001:db8::1", "2001:db8::1", "", 0},
+		"[2001:db8::1]":              {"2001:db8::1", "2001:db8::1", "", 0},
+		"[2001:db8::1]:22":           {"[2001:db8::1]:22", "2001:db8::1", "", 22},
+		"root@[2001:db8::1]:22":      {"root@[2001:db8::1]:22", "2001:db8::1", "root", 22},
+		"ssh://host":                 {"host", "host", "", 0},
+		"ssh://user@host:2222":       {"user@host:2222", "host", "user", 2222},
+		"ssh://user@[2001:db8::1]:2": {"user@[2001:db8::1]:2", "2001:db8::1", "user", 2},
+	} {
+		target, err := ParseTarget(s)
+		if err != nil {
+			t.Error(s, err)
+			continue
+		}
+		if target != expect {
+			t.Error(s, target)
+		}
+	}
+}
+
+func TestParseTargetMalformed(t *testing.T) {
+	for _, s := range []string{
+		"", "@host", "user@", "host:", "host:0", "host:port", "[::1",
+		"[::1]x", "ssh://", "ssh://host/path", "ho st",
+	} {
+		if _, err := ParseTarget(s); err == nil {
+			t.Error("accepted:", s)
+		}
+	}
+}
+
+func TestNewHostTarget(t *testing.T) {
+	host, err := NewHost("deploy@web1:2222")
+	assert(err)
+	if host.Name != "deploy@web1:2222" ||
+		host.Env["HOSTNAME"] != "deploy@web1:2222" {
+		t.Error("name:", host.Name)
+	}
+	args := host.connectArgs()
+	if len(args) != 4 || args[1] != "User=deploy" || args[3] != "Port=2222" {
+		t.Error("args:", args)
+	}
+}
@@ -3,40 +3,108 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
-	"runtime"
 	"strings"
 	"time"
 )
 
-const (
-	sshControlPath      = "~/.ssh/judo-control-%C"
-	sshControlPathOpt   = "-o ControlPath=" + sshControlPath
-	sshBatchOpt         = "-o BatchMode=yes"
-	sshControlMasterOpt = "-o ControlMaster=no"
-)
+// Transport connects a Host to the machine it represents, and runs
+// commands there.
+type Transport interface {
+	// Connect prepares the connection, e.g. starts a master process
+	// to speed up consecutive commands.
+	Connect(job *Job) error
+	// Run starts the given shell command line on the host. If stdin
+	// is not nil, the command reads its standard input from it.
+	Run(job *Job, cmdline string, stdin io.Reader) (*Proc, error)
+	// Push starts copying a local file or directory into the given
+	// remote directory.
+	Push(job *Job, local string, remote string) (*Proc, error)
+	// Close tears down the connection.
+	Close() error
+}
+
+// transportNames are the names of the transports NewTransport knows.
+var transportNames = []string{"", "ssh", "local", "exec"}
+
+// CheckTransport reports an error if there's no transport with the
+// given name.
+func CheckTransport(name string) error {
+	if !contains(transportNames, name) {
+		return fmt.Errorf("unknown transport: %s", name)
+	}
+	return nil
+}
+
+// NewTransport creates the named transport for the host.
+func NewTransport(name string, host *Host) (Transport, error) {
+	switch name {
+	case "", "ssh":
+		return &sshTransport{host: host}, nil
+	case "local":
+		return &localTransport{host: host}, nil
+	case "exec":
+		return newExecTransport(host)
+	}
+	return nil, fmt.Errorf("unknown transport: %s", name)
+}
+
+// failedTransport stands in for a transport that couldn't be set up,
+// so that the host fails when it's used, rather than the whole run.
+type failedTransport struct {
+	err error
+}
+
+func (t *failedTransport) Connect(job *Job) error {
+	return t.err
+}
+
+func (t *failedTransport) Run(job *Job, cmdline string, stdin io.Reader) (*Proc, error) {
+	return nil, t.err
+}
+
+func (t *failedTransport) Push(job *Job, local string, remote string) (*Proc, error) {
+	return nil, t.err
+}
+
+func (t *failedTransport) Close() error {
+	return nil
+}
 
+// pushFiles copies the local file or directory into the remote
+// directory, either with the transport's own means, or as a tar
+// archive, as the job says.
 func (host *Host) pushFiles(job *Job,
-	fnameLocal string, fnameRemote string) (err error) {
-	var remote = fmt.Sprintf("[%s]:%s", host.Name, fnameRemote)
-	scpArgs := []string{}
-	scpArgs = append(scpArgs, host.SshArgs...)
-	scpArgs = append(
-		scpArgs,
-		sshBatchOpt,
-		sshControlPathOpt,
-		sshControlMasterOpt,
-		"-r",
-		fnameLocal,
-		remote,
-	)
-	proc, err := NewProc(
-		"scp",
-		scpArgs...,
-	)
+	fnameLocal string, fnameRemote string) error {
+	if job.Push == pushTar {
+		bundle, err := NewBundle(fnameLocal, job.Compress)
+		if err != nil {
+			return err
+		}
+		return host.pushBundle(job, bundle, fnameRemote)
+	}
+	proc, err := host.transport.Push(job, fnameLocal, fnameRemote)
+	if err != nil {
+		return err
+	}
+	return host.waitPush(job, proc)
+}
+
+// pushBundle streams the bundle to the remote host, unpacking it in
+// the remote directory.
+func (host *Host) pushBundle(job *Job, bundle *Bundle, fnameRemote string) error {
+	proc, err := host.transport.Run(job,
+		host.cmdline(bundle.UnpackCommand(fnameRemote)), bundle.Reader())
 	if err != nil {
-		return
+		return err
 	}
+	return host.waitPush(job, proc)
+}
+
+// waitPush logs the output of the given copying process, and reports
+// its exit status.
+func (host *Host) waitPush(job *Job, proc *Proc) (err error) {
 	close(proc.Stdin())
 	for {
 		select {
@@ -53,6 +121,7 @@ func (host *Host) pushFiles(job *Job,
 		case err = <-proc.Done():
 			return err
 		case <-time.After(job.Timeout):
+			proc.Kill()
 			return ErrorTimeout
 		case <-host.cancel:
 			if proc.IsAlive() {
@@ -87,33 +156,40 @@ func shargs(ss []string) string {
 	return strings.Join(ss, " ")
 }
 
-func (host *Host) startSSH(job *Job, command string) (proc *Proc, err error) {
-	sshArgs := []string{}
-	sshArgs = append(sshArgs, host.SshArgs...)
-	sshArgs = append(
-		sshArgs,
-		sshBatchOpt,
-		sshControlPathOpt,
-		sshControlMasterOpt,
-		host.Name,
-	)
+// cmdline builds the shell command line that runs the given command
+// on the host: in the workdir, if there is one, and with the host's
+// environment.
+func (host *Host) cmdline(command string) string {
+	var args []string
 	if host.workdir != "" {
-		sshArgs = append(sshArgs, []string{
-			"cd", host.workdir, "&&",
-		}...)
+		args = append(args, "cd", shquote(host.workdir), "&&")
 	}
-	sshArgs = append(sshArgs, "env")
-	for key, value := range host.Env {
-		sshArgs = append(sshArgs, fmt.Sprintf("%s=%s", key, shquote(value)))
+	args = append(args, "env")
+	for key, value := range host.Environment() {
+		args = append(args, fmt.Sprintf("%s=%s", key, shquote(value)))
+	}
+	args = append(args, "sh", "-c", shquote(command))
+	return strings.Join(args, " ")
+}
+
+// start starts the given shell command on the host.
+func (host *Host) start(job *Job, command string) (proc *Proc, err error) {
+	return host.transport.Run(job, host.cmdline(command), nil)
+}
+
+// Exec executes the given shell command on the remote host, and
+// reports exit status.
+func (host *Host) Exec(job *Job, command string) (err error) {
+	proc, err := host.start(job, command)
+	if err != nil {
+		return err
 	}
-	sshArgs = append(sshArgs, "sh", "-c", shquote(command))
-	return NewProc("ssh", sshArgs...)
+	return host.follow(job, proc)
 }
 
-// SSH executes the given shell command on the remote host, and
-// reports exist status.
-func (host *Host) SSH(job *Job, command string) (err error) {
-	proc, err := host.startSSH(job, command)
+// follow logs the output of the given process (recording it in
+// Output, if asked to), and reports its exit status.
+func (host *Host) follow(job *Job, proc *Proc) (err error) {
 	close(proc.Stdin())
 	for {
 		select {
@@ -122,6 +198,9 @@ func (host *Host) SSH(job *Job, command string) (err error) {
 				continue
 			}
 			host.logger.Println(line)
+			if host.recording {
+				host.Output = append(host.Output, line)
+			}
 		case line, ok := <-proc.Stderr():
 			if !ok {
 				continue
@@ -130,6 +209,7 @@ func (host *Host) SSH(job *Job, command string) (err error) {
 		case err = <-proc.Done():
 			return err
 		case <-time.After(job.Timeout):
+			proc.Kill()
 			return ErrorTimeout
 		case <-host.cancel:
 			if proc.IsAlive() {
@@ -140,10 +220,13 @@ func (host *Host) SSH(job *Job, command string) (err error) {
 	}
 }
 
-// SSHRead executes the given shell command on the remote host, and
+// ExecRead executes the given shell command on the remote host, and
 // returns its output together with exit status.
-func (host *Host) SSHRead(job *Job, command string) (out string, err error) {
-	proc, err := host.startSSH(job, command)
+func (host *Host) ExecRead(job *Job, command string) (out string, err error) {
+	proc, err := host.start(job, command)
+	if err != nil {
+		return "", err
+	}
 	close(proc.Stdin())
 	for {
 		select {
@@ -160,6 +243,7 @@ func (host *Host) SSHRead(job *Job, command string) (out string, err error) {
 		case err = <-proc.Done():
 			return
 		case <-time.After(job.Timeout):
+			proc.Kill()
 			return "", ErrorTimeout
 		case <-host.cancel:
 			if proc.IsAlive() {
@@ -170,56 +254,48 @@ func (host *Host) SSHRead(job *Job, command string) (out string, err error) {
 	}
 }
 
-// StartMaster starts the SSH master process for this host, to speed
-// up execution of consecutive SSH requests.
-func (host *Host) StartMaster() (err error) {
-	if runtime.GOOS == "windows" {
-		// Master process on Windows seems problematic
-		return nil
-	}
-	if host.master != nil {
-		panic("there already is a master")
-	}
-        sshArgs := []string{}
-        sshArgs = append(sshArgs, host.SshArgs...)
-        sshArgs = append(sshArgs, sshBatchOpt, sshControlPathOpt, "-MN", host.Name)
-        proc, err := NewProc("ssh", sshArgs...)
+// ExecReadLines executes the given shell command on the remote host,
+// and returns all of its output lines together with exit status.
+func (host *Host) ExecReadLines(job *Job, command string) (lines []string, err error) {
+	return host.readLines(job, host.cmdline(command))
+}
+
+// readLines runs the given command line on the remote host as is,
+// and returns all of its output lines together with exit status.
+func (host *Host) readLines(job *Job, cmdline string) (lines []string, err error) {
+	return host.readLinesInput(job, cmdline, nil)
+}
+
+// readLinesInput is like readLines, but the command reads its
+// standard input from stdin, if it's not nil.
+func (host *Host) readLinesInput(job *Job, cmdline string, stdin io.Reader) (lines []string, err error) {
+	proc, err := host.transport.Run(job, cmdline, stdin)
 	if err != nil {
-		return
-	}
-	host.master = proc
-	go func() {
-		for host.master != nil {
-			select {
-			case line, ok := <-host.master.Stdout():
-				if !ok {
-					continue
-				}
-				host.logger.Println(line)
-			case line, ok := <-host.master.Stderr():
-				if !ok {
-					continue
-				}
-				host.logger.Println(line)
-			case err = <-host.master.Done():
-				if err != nil {
-					host.logger.Println(err.Error())
-				}
-				host.master = nil
-			case <-host.cancel:
-				host.master.CloseStdin()
-				host.StopMaster()
+		return nil, err
+	}
+	close(proc.Stdin())
+	for {
+		select {
+		case line, ok := <-proc.Stdout():
+			if !ok {
+				continue
+			}
+			lines = append(lines, line)
+		case line, ok := <-proc.Stderr():
+			if !ok {
+				continue
+			}
+			host.logger.Println(line)
+		case err = <-proc.Done():
+			return
+		case <-time.After(job.Timeout):
+			proc.Kill()
+			return nil, ErrorTimeout
+		case <-host.cancel:
+			if proc.IsAlive() {
+				proc.Signal(os.Interrupt)
 			}
+			return nil, ErrorCancel
 		}
-	}()
-	return
-}
-
-// StopMaster kills the master process.
-func (host *Host) StopMaster() error {
-	if host.master == nil || !host.master.IsAlive() {
-		host.logger.Println("there was no master to stop")
-		return nil
 	}
-	return host.master.Signal(os.Interrupt)
 }
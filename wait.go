@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Things to wait for.
+const (
+	waitUp     = "up"
+	waitDown   = "down"
+	waitReboot = "reboot"
+
+	defaultWaitTimeout = 5 * time.Minute
+)
+
+// waitPollInterval is how long to wait between attempts to reach the
+// host.
+var waitPollInterval = 2 * time.Second
+
+// bootIDProbe prints a value that changes with every boot.
+const bootIDProbe = `cat /proc/sys/kernel/random/boot_id 2> /dev/null ||
+sysctl -n kern.boottime`
+
+// rebootCommand reboots the host, giving the connection a moment to
+// finish.
+const rebootCommand = `(sleep 1; reboot) > /dev/null 2>&1 &`
+
+// poll runs the probe on the host over a new connection every
+// waitPollInterval, until done says the probe's output and exit status
+// are what we're waiting for, or the deadline passes. Each attempt is
+// bounded by what's left until the deadline.
+func (host *Host) poll(job *Job, deadline time.Time, probe string,
+	done func(out string, err error) bool) error {
+	for {
+		attempt := *job
+		attempt.Timeout = time.Until(deadline)
+		if attempt.Timeout > job.Timeout {
+			attempt.Timeout = job.Timeout
+		}
+		if attempt.Timeout <= 0 {
+			return ErrorTimeout
+		}
+		attempt.ConnectTimeout = attempt.Timeout
+		out, err := host.ExecRead(&attempt, probe)
+		if errors.Is(err, ErrorCancel) || errors.Is(err, ErrorPending) {
+			return err
+		}
+		if err == ErrorTimeout && time.Now().After(deadline) {
+			// cut short by the deadline, the attempt proves nothing
+			return ErrorTimeout
+		}
+		if done(out, err) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrorTimeout
+		}
+		select {
+		case <-time.After(waitPollInterval):
+		case <-host.cancel:
+			return ErrorCancel
+		}
+	}
+}
+
+// WaitUp waits until the host can be reached.
+func (host *Host) WaitUp(job *Job) error {
+	return host.poll(job, time.Now().Add(job.WaitTimeout), "true",
+		func(out string, err error) bool { return err == nil })
+}
+
+// WaitDown waits until the host can't be reached anymore.
+func (host *Host) WaitDown(job *Job) error {
+	return host.poll(job, time.Now().Add(job.WaitTimeout), "true",
+		func(out string, err error) bool { return err != nil })
+}
+
+// Reboot reboots the host, and waits until it's back up with a new
+// boot ID. It doesn't need to catch the host while it's down: a new
+// boot ID is proof enough, however quickly the host came back.
+func (host *Host) Reboot(job *Job) error {
+	before, err := host.ExecRead(job, bootIDProbe)
+	if err != nil {
+		return err
+	}
+	if err = host.Exec(job, rebootCommand); err != nil {
+		return err
+	}
+	unchanged := false
+	err = host.poll(job, time.Now().Add(job.WaitTimeout), bootIDProbe,
+		func(out string, err error) bool {
+			unchanged = err == nil && out == before
+			return err == nil && out != before
+		})
+	if err == ErrorTimeout && unchanged {
+		return fmt.Errorf("boot ID unchanged: %s", before)
+	}
+	return err
+}
+
+// WaitHosts waits for all hosts to come up, go down, or reboot, as the
+// job says.
+func (job *Job) WaitHosts() *JobResult {
+	return job.each(func(host *Host) error {
+		switch job.Wait {
+		case waitUp:
+			return host.WaitUp(job)
+		case waitDown:
+			return host.WaitDown(job)
+		case waitReboot:
+			return host.Reboot(job)
+		}
+		panic("Should not happen")
+	})
+}
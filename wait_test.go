@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeMachine returns a host reached through a wrapper, which
+// pretends the machine is down unless $state/up exists, and reads
+// the boot ID from $state/boot_id. A fake reboot(8) takes the machine
+// down, changes its boot ID, and brings it back up.
+func newFakeMachine(t *testing.T) (host *Host, state string) {
+	state = t.TempDir()
+	bin := t.TempDir()
+	assert(os.WriteFile(path.Join(bin, "machine"), []byte(`#!/bin/sh
+state=`+shquote(state)+`
+[ -e "$state/up" ] || exit 255
+shift 2
+exec sh -c "$(echo "$1" | sed "s|/proc/sys/kernel/random/boot_id|$state/boot_id|")"
+`), 0755))
+	assert(os.WriteFile(path.Join(bin, "reboot"), []byte(`#!/bin/sh
+state=`+shquote(state)+`
+rm "$state/up"
+echo after > "$state/boot_id"
+sleep 0.3
+touch "$state/up"
+`), 0755))
+	assert(os.WriteFile(path.Join(state, "boot_id"), []byte("before\n"), 0644))
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	t.Setenv("HOME", t.TempDir())
+
+	waitPollInterval = 50 * time.Millisecond
+	t.Cleanup(func() {
+		waitPollInterval = 2 * time.Second
+	})
+
+	host, err := NewHost("machine")
+	assert(err)
+	host.logger.SetOutput(&strings.Builder{})
+	host.Vars["judo_exec"] = path.Join(bin, "machine")
+	host.Vars["judo_copy"] = "false {src} {dst}"
+	assert(host.SetTransport("exec"))
+	return
+}
+
+func TestHostWaitUp(t *testing.T) {
+	host, state := newFakeMachine(t)
+	job := newTestJob(nil, nil)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		assert(os.WriteFile(path.Join(state, "up"), nil, 0644))
+	}()
+	if err := host.WaitUp(job); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHostWaitDownTimeout(t *testing.T) {
+	host, state := newFakeMachine(t)
+	assert(os.WriteFile(path.Join(state, "up"), nil, 0644))
+	job := newTestJob(nil, nil)
+	job.WaitTimeout = 200 * time.Millisecond
+	if err := host.WaitDown(job); err != ErrorTimeout {
+		t.Error("err:", err)
+	}
+}
+
+func TestHostReboot(t *testing.T) {
+	host, state := newFakeMachine(t)
+	assert(os.WriteFile(path.Join(state, "up"), nil, 0644))
+	job := newTestJob(nil, nil)
+	if err := host.Reboot(job); err != nil {
+		t.Error(err)
+	}
+
+	// a machine that doesn't really reboot
+	assert(os.WriteFile(path.Join(state, "boot_id"), []byte("after\n"), 0644))
+	job.WaitTimeout = 500 * time.Millisecond
+	job.Wait = waitReboot
+	job.Inventory.hosts = []*Host{host}
+	result := job.WaitHosts()
+	if err := (*result)[host]; err == nil ||
+		!strings.HasPrefix(err.Error(), "boot ID unchanged") {
+		t.Error("err:", err)
+	}
+}
+
+func TestHostRebootFast(t *testing.T) {
+	host, state := newFakeMachine(t)
+	assert(os.WriteFile(path.Join(state, "up"), nil, 0644))
+	// a machine that's back before anyone notices it was gone
+	bin := path.Dir(host.Vars["judo_exec"])
+	assert(os.WriteFile(path.Join(bin, "reboot"), []byte(`#!/bin/sh
+echo after > `+shquote(path.Join(state, "boot_id"))+`
+`), 0755))
+	job := newTestJob(nil, nil)
+	job.WaitTimeout = 2 * time.Second
+	if err := host.Reboot(job); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHostWaitAttemptTimeout(t *testing.T) {
+	host, state := newFakeMachine(t)
+	assert(os.WriteFile(path.Join(state, "up"), nil, 0644))
+	// a machine that hangs instead of answering
+	bin := path.Dir(host.Vars["judo_exec"])
+	assert(os.WriteFile(path.Join(bin, "machine"), []byte(`#!/bin/sh
+echo $$ > `+shquote(path.Join(state, "pid"))+`
+exec sleep 30
+`), 0755))
+	job := newTestJob(nil, nil)
+	job.WaitTimeout = 300 * time.Millisecond
+	start := time.Now()
+	if err := host.WaitUp(job); err != ErrorTimeout {
+		t.Error("err:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Error("attempt overshot the deadline:", elapsed)
+	}
+	pid, err := os.ReadFile(path.Join(state, "pid"))
+	assert(err)
+	time.Sleep(100 * time.Millisecond)
+	if exec.Command("kill", "-0", strings.TrimSpace(string(pid))).Run() == nil {
+		t.Error("attempt left running")
+	}
+}
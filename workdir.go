@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Policies for keeping the remote workdir after the job.
+const (
+	keepNever     = "never"
+	keepOnFailure = "on-failure"
+	keepAlways    = "always"
+)
+
+// workdirFallbacks are tried, in order, if the remote directory
+// can't be used, or is mounted noexec.
+const workdirFallbacks = `"${TMPDIR:-/tmp}" /var/tmp`
+
+// selectWorkdirScript creates a workdir, $w, in the first of the
+// given base directories (1) where it can be created, and where files
+// can be executed; that base is $b. Problems with the others are
+// printed as "warning: " lines. If there's no usable one, it runs the
+// given command (2), which should exit.
+const selectWorkdirScript = `
+w=
+for b in %s; do
+	if ! mkdir -p "$b" 2> /dev/null ||
+		! w=$(TMPDIR="$b" mktemp -d 2> /dev/null); then
+		echo "warning: can't create workdir in $b"
+		w=
+		continue
+	fi
+	# without chmod(1), there's no telling; assume it's fine
+	echo "exit 0" > "$w/.judo-exec"
+	if ! chmod +x "$w/.judo-exec" 2> /dev/null ||
+		"$w/.judo-exec" 2> /dev/null; then
+		rm "$w/.judo-exec"
+		break
+	fi
+	echo "warning: can't execute files in $b"
+	rm -r "$w"
+	w=
+done
+if [ -z "$w" ]; then
+	echo "no usable remote directory"
+	%s
+fi
+`
+
+// selectWorkdir returns the shell script that creates a workdir in
+// the host's remote directory, or if that isn't usable (e.g. it's
+// read-only, or mounted noexec), in a temporary directory; see
+// selectWorkdirScript. Every way of running a job picks its workdir
+// this way.
+func (host *Host) selectWorkdir(job *Job, fail string) string {
+	return fmt.Sprintf(selectWorkdirScript,
+		host.remoteDir(job)+" "+workdirFallbacks, fail)
+}
+
+// shellPath returns a shell expression for the remote directory: as
+// is, with a leading "~" meaning $HOME, or $HOME/.judo if empty.
+func shellPath(dir string) string {
+	switch {
+	case dir == "":
+		return `"$HOME/.judo"`
+	case dir == "~":
+		return `"$HOME"`
+	case strings.HasPrefix(dir, "~/"):
+		return `"$HOME"/` + shquote(dir[2:])
+	}
+	return shquote(dir)
+}
+
+// remoteDir returns the shell expression for the directory where the
+// host's workdirs are created: from the judo_remote_dir var, or the
+// job's RemoteDir.
+func (host *Host) remoteDir(job *Job) string {
+	if dir, ok := host.Vars["judo_remote_dir"]; ok {
+		return shellPath(dir)
+	}
+	return shellPath(job.RemoteDir)
+}
+
+// makeWorkdir creates a fresh workdir on the host, in its remote
+// directory, or if that isn't usable (e.g. it's read-only, or mounted
+// noexec), in a temporary directory, and marks it as the job's.
+// Problems are recorded in the host's warnings. If the job says so,
+// stale workdirs are removed first.
+func (host *Host) makeWorkdir(job *Job) (workdir string, err error) {
+	script := host.selectWorkdir(job, "exit 1") +
+		markerCommand(job, `"$w"`) + " || exit\n" +
+		`echo "workdir $w"` + "\n"
+	if job.Prune {
+		script = host.gcCommand(job) + script
+	}
+	lines, err := host.ExecReadLines(job, script)
+	for _, line := range host.logRemoved(lines) {
+		if warning := strings.TrimPrefix(line, "warning: "); warning != line {
+			host.Warnings = append(host.Warnings, warning)
+		} else if strings.HasPrefix(line, "workdir ") {
+			workdir = strings.TrimPrefix(line, "workdir ")
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("no usable remote directory: %s", err)
+	}
+	if workdir == "" {
+		return "", fmt.Errorf("no usable remote directory")
+	}
+	return workdir, nil
+}
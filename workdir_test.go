@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestShellPath(t *testing.T) {
+	for dir, expect := range map[string]string{
+		"":           `"$HOME/.judo"`,
+		"~":          `"$HOME"`,
+		"~/my work":  `"$HOME"/'my work'`,
+		"/srv/judo":  `'/srv/judo'`,
+		"~other/dir": `'~other/dir'`,
+	} {
+		if s := shellPath(dir); s != expect {
+			t.Errorf("%q: %s", dir, s)
+		}
+	}
+}
+
+func writeTestScript(t *testing.T, body string) *Script {
+	fname := path.Join(t.TempDir(), "test.sh")
+	assert(os.WriteFile(fname, []byte("#!/bin/sh\n"+body), 0755))
+	script, err := NewScript(fname)
+	assert(err)
+	return script
+}
+
+func TestHostRemoteDir(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	host.Vars["judo_remote_dir"] = "~/work"
+	job := newTestJob(writeTestScript(t, "pwd\n"), nil)
+	job.RemoteDir = "/nonexistent"
+	if err := host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	work := path.Join(os.Getenv("HOME"), "work")
+	if len(host.Output) != 1 || path.Dir(host.Output[0]) != work {
+		t.Error("output:", host.Output)
+	}
+	entries, err := os.ReadDir(work)
+	assert(err)
+	if len(entries) != 0 {
+		t.Error("workdir left behind:", entries[0].Name())
+	}
+}
+
+func TestHostRemoteDirFallback(t *testing.T) {
+	host := newLocalHost(t, "localhost")
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	job := newTestJob(writeTestScript(t, "pwd\n"), nil)
+	job.RemoteDir = "/proc/judo"
+	if err := host.SendRemoteAndRun(job); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(host.Output) != 1 || path.Dir(host.Output[0]) != tmp {
+		t.Error("output:", host.Output)
+	}
+	if len(host.Warnings) != 1 ||
+		host.Warnings[0] != "can't create workdir in /proc/judo" {
+		t.Error("warnings:", host.Warnings)
+	}
+}
+
+func TestHostKeepWorkdir(t *testing.T) {
+	for _, c := range []struct {
+		keep string
+		body string
+		kept bool
+	}{
+		{keepNever, "exit 1\n", false},
+		{keepOnFailure, "exit 0\n", false},
+		{keepOnFailure, "exit 1\n", true},
+		{keepAlways, "exit 0\n", true},
+	} {
+		host := newLocalHost(t, "localhost")
+		job := newTestJob(writeTestScript(t, "echo hi > out\n"+c.body), nil)
+		job.KeepWorkdir = c.keep
+		host.SendRemoteAndRun(job)
+		if (host.KeptWorkdir != "") != c.kept {
+			t.Errorf("%s, %s: kept %q", c.keep, strings.TrimSpace(c.body), host.KeptWorkdir)
+			continue
+		}
+		if !c.kept {
+			assertNoWorkdirs(t)
+			continue
+		}
+		b, err := os.ReadFile(path.Join(host.KeptWorkdir, "out"))
+		if err != nil || string(b) != "hi\n" {
+			t.Error("kept workdir:", err)
+		}
+	}
+}